@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"sync"
+)
+
+// ownChildren holds the pids of the processes confik starts itself: the
+// command, git and the watchdog. Their exit status belongs to whoever waits
+// for them, so reaping orphans in --wait-tree and --init mode leaves them
+// alone. The lock is held while a child starts and while orphans are reaped,
+// so a reaper never sees a child before it has been recorded.
+var ownChildren = struct {
+	sync.Mutex
+	pids map[int]bool
+}{pids: map[int]bool{}}
+
+// startOwnChild starts cmd and records it as one of confik's own children.
+func startOwnChild(cmd *exec.Cmd) error {
+	ownChildren.Lock()
+	defer ownChildren.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	ownChildren.pids[cmd.Process.Pid] = true
+	return nil
+}
+
+// forgetOwnChild drops pid from the own children once it has been waited for.
+// Callers save the pid before waiting: a wait that releases cmd.Process
+// resets its Pid.
+func forgetOwnChild(pid int) {
+	ownChildren.Lock()
+	defer ownChildren.Unlock()
+	delete(ownChildren.pids, pid)
+}
+
+// runOwnChild is cmd.Run for one of confik's own children.
+func runOwnChild(cmd *exec.Cmd) error {
+	if err := startOwnChild(cmd); err != nil {
+		return err
+	}
+	defer forgetOwnChild(cmd.Process.Pid)
+	return cmd.Wait()
+}
+
+// outputOwnChild is cmd.Output for one of confik's own children.
+func outputOwnChild(cmd *exec.Cmd) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := runOwnChild(cmd)
+	return stdout.Bytes(), err
+}
@@ -19,7 +19,7 @@ func combineErrors(primary, secondary error) error {
 	return fmt.Errorf("%v; %v", primary, secondary)
 }
 
-func cleanupStagedArtifacts(manifestPath string, createdFiles, createdDirs []string, vscodeContext *VSCodeContext, gitContext *GitContext, unlock func() error, removeManifest bool) error {
+func cleanupStagedArtifacts(manifestPath string, createdFiles, createdDirs []string, vscodeContext *VSCodeContext, gitContext *GitContext, hgContext *HgContext, unlock func() error, removeManifest bool) error {
 	failures := []string{}
 	remaining := map[string]struct{}{}
 
@@ -74,6 +74,11 @@ func cleanupStagedArtifacts(manifestPath string, createdFiles, createdDirs []str
 			recordFailure("remove gitignore block %s: %v", gitContext.ExcludePath, err)
 		}
 	}
+	if hgContext != nil {
+		if err := removeHgIgnoreBlock(hgContext); err != nil {
+			recordFailure("remove hgignore block %s: %v", hgContext.IgnorePath, err)
+		}
+	}
 
 	shouldRemoveManifest := removeManifest && len(failures) == 0 && len(remaining) == 0
 	if shouldRemoveManifest {
@@ -111,9 +116,21 @@ func cleanupStagedArtifacts(manifestPath string, createdFiles, createdDirs []str
 	return errors.New(strings.Join(parts, "; "))
 }
 
-func cleanLeftovers(cwd string, force bool, quiet bool) error {
-	configDir := filepath.Join(cwd, ".config")
-	manifestPath := filepath.Join(configDir, manifestFilename)
+// cleanupManifestArtifacts removes everything a manifest recorded, resolving
+// its relative paths against cwd.
+func cleanupManifestArtifacts(cwd, manifestPath string, manifest *Manifest, unlock func() error) error {
+	createdFiles := make([]string, 0, len(manifest.CreatedFiles))
+	for _, rel := range manifest.CreatedFiles {
+		createdFiles = append(createdFiles, filepath.Join(cwd, rel))
+	}
+	createdDirs := make([]string, 0, len(manifest.CreatedDirs))
+	for _, rel := range manifest.CreatedDirs {
+		createdDirs = append(createdDirs, filepath.Join(cwd, rel))
+	}
+	return cleanupStagedArtifacts(manifestPath, createdFiles, createdDirs, manifest.VSCode, manifest.Gitignore, manifest.Mercurial, unlock, true)
+}
+
+func cleanLeftovers(cwd, manifestPath string, force bool, quiet bool) error {
 	cleaned := false
 	var cleanupErr error
 
@@ -123,26 +140,21 @@ func cleanLeftovers(cwd string, force bool, quiet bool) error {
 			cleanupErr = fmt.Errorf("failed to read manifest %s (%v)", manifestPath, err)
 		}
 		if manifest != nil {
-			createdFiles := make([]string, 0, len(manifest.CreatedFiles))
-			for _, rel := range manifest.CreatedFiles {
-				createdFiles = append(createdFiles, filepath.Join(cwd, rel))
-			}
-			createdDirs := make([]string, 0, len(manifest.CreatedDirs))
-			for _, rel := range manifest.CreatedDirs {
-				createdDirs = append(createdDirs, filepath.Join(cwd, rel))
-			}
-			cleanupErr = cleanupStagedArtifacts(manifestPath, createdFiles, createdDirs, manifest.VSCode, manifest.Gitignore, nil, true)
+			cleanupErr = cleanupManifestArtifacts(cwd, manifestPath, manifest, nil)
 			cleaned = true
 		}
 	}
 
 	if !cleaned && force {
-		gitRoot := findGitRoot(cwd)
-		if gitRoot != "" {
-			if gitDir, err := resolveGitDir(gitRoot); err == nil {
+		root, kind := findVCSRoot(cwd)
+		switch kind {
+		case vcsGit:
+			if gitDir, err := resolveGitDir(root); err == nil {
 				excludePath := filepath.Join(gitDir, "info", "exclude")
 				cleanupErr = combineErrors(cleanupErr, removeAllGitIgnoreBlocks(excludePath))
 			}
+		case vcsMercurial:
+			cleanupErr = combineErrors(cleanupErr, removeAllHgIgnoreBlocks(root))
 		}
 	}
 
@@ -58,7 +58,7 @@ func TestCleanLeftoversFromManifest(t *testing.T) {
 			t.Fatalf("write manifest: %v", err)
 		}
 
-		if err := cleanLeftovers(base, true, false); err != nil {
+		if err := cleanLeftovers(base, filepath.Join(base, ".config", manifestFilename), true, false); err != nil {
 			t.Fatalf("cleanLeftovers error: %v", err)
 		}
 
@@ -98,7 +98,7 @@ func TestCleanLeftoversFromManifest(t *testing.T) {
 			t.Fatalf("write manifest: %v", err)
 		}
 
-		if err := cleanLeftovers(base, true, false); err != nil {
+		if err := cleanLeftovers(base, filepath.Join(base, ".config", manifestFilename), true, false); err != nil {
 			t.Fatalf("cleanLeftovers should not error for already-removed files: %v", err)
 		}
 		if _, err := os.Stat(filepath.Join(configDir, manifestFilename)); err == nil {
@@ -155,7 +155,7 @@ func TestCleanLeftoversRemovesBlocksWithoutManifest(t *testing.T) {
 		t.Fatalf("write exclude: %v", err)
 	}
 
-	if err := cleanLeftovers(base, true, false); err != nil {
+	if err := cleanLeftovers(base, filepath.Join(base, ".config", manifestFilename), true, false); err != nil {
 		t.Fatalf("cleanLeftovers error: %v", err)
 	}
 
@@ -191,7 +191,7 @@ func TestCleanLeftoversFailsWhenKnownArtifactsRemain(t *testing.T) {
 		t.Fatalf("write manifest: %v", err)
 	}
 
-	err := cleanLeftovers(base, true, true)
+	err := cleanLeftovers(base, filepath.Join(base, ".config", manifestFilename), true, true)
 	if err == nil {
 		t.Fatalf("expected cleanup to report remaining artifacts")
 	}
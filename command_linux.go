@@ -0,0 +1,12 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// commandSysProcAttr asks the kernel to send SIGTERM to the wrapped command if
+// confik dies without getting to stop it, so the watchdog does not remove
+// staged files from under a command that keeps running.
+func commandSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+}
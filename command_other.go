@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// commandSysProcAttr has no parent-death signal outside Linux.
+func commandSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// dirWritable reports whether files can be created in dir. Read-only mounts
+// report EROFS here without anything being written.
+func dirWritable(dir string) bool {
+	return unix.Access(dir, unix.W_OK) == nil
+}
@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// dirWritable reports whether files can be created in dir. Windows has no
+// access(2), so this checks the read-only attribute only.
+func dirWritable(dir string) bool {
+	info, err := os.Stat(dir)
+	return err == nil && info.Mode().Perm()&0o200 != 0
+}
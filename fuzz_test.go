@@ -23,6 +23,35 @@ func FuzzMatchesPatternList(f *testing.F) {
 	})
 }
 
+func FuzzIgnoreMatcher(f *testing.F) {
+	f.Add("foo.local", "*.local")
+	f.Add("config/foo.local", "/config/*.local")
+	f.Add("private/secret.txt", "private/")
+	f.Add("private/secret.txt", "private/**")
+	f.Add("a/b/c.txt", "a/**/c.txt")
+	f.Add("#hash", `\#hash`)
+	f.Add("!bang", `\!bang`)
+	f.Add("a.txt", "!a.txt")
+	f.Add("a.txt", "[")
+	f.Add("a.txt", "/")
+
+	f.Fuzz(func(t *testing.T, target, pattern string) {
+		matcher := compileIgnore([]string{pattern})
+		matched := matcher.matches(target)
+		if pattern == "" || strings.HasPrefix(pattern, "!") || strings.HasPrefix(pattern, "#") || strings.HasPrefix(pattern, `\`) {
+			return
+		}
+		// Re-including everything a rule ignores must leave nothing ignored.
+		if compileIgnore([]string{pattern, "!" + pattern}).matches(target) {
+			t.Errorf("%q followed by its negation still ignores %q", pattern, target)
+		}
+		// A rule ignores the same paths when repeated.
+		if compileIgnore([]string{pattern, pattern}).matches(target) != matched {
+			t.Errorf("repeating %q changed the result for %q", pattern, target)
+		}
+	})
+}
+
 func FuzzRemoveGitIgnoreBlocks(f *testing.F) {
 	// Seed corpus
 	f.Add("# confik:start:abc\nfoo\n# confik:end:abc\n", "abc")
@@ -56,22 +56,26 @@ func resolveGitDir(gitRoot string) (string, error) {
 }
 
 func appendGitIgnoreBlock(gitDir, runID string, paths []string) (string, error) {
-	infoDir := filepath.Join(gitDir, "info")
-	excludePath := filepath.Join(infoDir, "exclude")
+	excludePath := filepath.Join(gitDir, "info", "exclude")
+	return excludePath, appendIgnoreBlock(excludePath, runID, paths)
+}
 
-	if err := os.MkdirAll(infoDir, 0o750); err != nil {
-		return "", err
+// appendIgnoreBlock adds a run-scoped block of patterns to an ignore file.
+// Blocks are delimited by confik markers so they can be removed per run.
+func appendIgnoreBlock(ignorePath, runID string, paths []string) error {
+	if err := os.MkdirAll(filepath.Dir(ignorePath), 0o750); err != nil {
+		return err
 	}
 
 	blockStart := fmt.Sprintf("# confik:start:%s", runID)
 	blockEnd := fmt.Sprintf("# confik:end:%s", runID)
 
 	existing := ""
-	// #nosec G304 -- excludePath is derived from resolved git dir.
-	if data, err := os.ReadFile(excludePath); err == nil {
+	// #nosec G304 -- ignorePath is derived from the resolved VCS dir.
+	if data, err := os.ReadFile(ignorePath); err == nil {
 		existing = string(data)
 		if strings.Contains(existing, blockStart) {
-			return excludePath, nil
+			return nil
 		}
 	}
 
@@ -83,7 +87,33 @@ func appendGitIgnoreBlock(gitDir, runID string, paths []string) (string, error)
 		existing += "\n"
 	}
 
-	return excludePath, os.WriteFile(excludePath, []byte(existing+block), 0o600)
+	return os.WriteFile(ignorePath, []byte(existing+block), 0o600)
+}
+
+// applyGitIgnore adds staged files to .git/info/exclude. Failures are not
+// fatal: staging proceeds without the temporary ignore rules.
+func applyGitIgnore(gitRoot, runID string, createdFiles []string) *GitContext {
+	gitDir, err := resolveGitDir(gitRoot)
+	if err != nil {
+		return nil
+	}
+	relPaths := []string{}
+	for _, posixRel := range vcsRelativePaths(gitRoot, createdFiles) {
+		relPaths = append(relPaths, "/"+posixRel)
+	}
+	if len(relPaths) == 0 {
+		return nil
+	}
+	excludePath, err := appendGitIgnoreBlock(gitDir, runID, relPaths)
+	if err != nil {
+		return nil
+	}
+	return &GitContext{
+		GitRoot:     gitRoot,
+		GitDir:      gitDir,
+		ExcludePath: excludePath,
+		RunID:       runID,
+	}
 }
 
 func removeGitIgnoreBlock(excludePath, runID string) error {
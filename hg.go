@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	hgIgnoreFilename = "confik-ignore"
+	hgrcIgnoreKey    = "ignore.confik"
+	hgIgnoreHeader   = "syntax: regexp\n"
+)
+
+// HgContext records the temporary ignore rules registered in a Mercurial
+// repository. The ignore file is hooked up through ui.ignore.confik in
+// .hg/hgrc, which is removed again once no run blocks remain.
+type HgContext struct {
+	HgRoot     string `json:"hgRoot"`
+	HgrcPath   string `json:"hgrcPath"`
+	IgnorePath string `json:"ignorePath"`
+	RunID      string `json:"runId"`
+}
+
+func applyHgIgnore(hgRoot, runID string, createdFiles []string) *HgContext {
+	patterns := []string{}
+	for _, rel := range vcsRelativePaths(hgRoot, createdFiles) {
+		patterns = append(patterns, "^"+regexp.QuoteMeta(rel)+"$")
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	hgDir := filepath.Join(hgRoot, ".hg")
+	ctx := &HgContext{
+		HgRoot:     hgRoot,
+		HgrcPath:   filepath.Join(hgDir, "hgrc"),
+		IgnorePath: filepath.Join(hgDir, hgIgnoreFilename),
+		RunID:      runID,
+	}
+
+	if !exists(ctx.IgnorePath) {
+		if err := os.WriteFile(ctx.IgnorePath, []byte(hgIgnoreHeader), 0o600); err != nil {
+			return nil
+		}
+	}
+	if err := appendIgnoreBlock(ctx.IgnorePath, runID, patterns); err != nil {
+		return nil
+	}
+	if err := registerHgIgnore(ctx.HgrcPath, ctx.IgnorePath); err != nil {
+		_ = removeHgIgnoreBlock(ctx)
+		return nil
+	}
+	return ctx
+}
+
+func removeHgIgnoreBlock(ctx *HgContext) error {
+	if ctx == nil || ctx.IgnorePath == "" {
+		return nil
+	}
+	if err := removeGitIgnoreBlock(ctx.IgnorePath, ctx.RunID); err != nil {
+		return err
+	}
+	return releaseHgIgnoreFile(ctx.HgrcPath, ctx.IgnorePath)
+}
+
+func removeAllHgIgnoreBlocks(hgRoot string) error {
+	hgDir := filepath.Join(hgRoot, ".hg")
+	ignorePath := filepath.Join(hgDir, hgIgnoreFilename)
+	if err := removeAllGitIgnoreBlocks(ignorePath); err != nil {
+		return err
+	}
+	return releaseHgIgnoreFile(filepath.Join(hgDir, "hgrc"), ignorePath)
+}
+
+// releaseHgIgnoreFile deletes the confik ignore file and its hgrc entry once
+// no other run still has a block in it.
+func releaseHgIgnoreFile(hgrcPath, ignorePath string) error {
+	// #nosec G304 -- ignorePath is derived from the .hg directory.
+	data, err := os.ReadFile(ignorePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if strings.Contains(string(data), "# confik:start:") {
+		return nil
+	}
+	if err := os.Remove(ignorePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return unregisterHgIgnore(hgrcPath)
+}
+
+func registerHgIgnore(hgrcPath, ignorePath string) error {
+	existing := ""
+	// #nosec G304 -- hgrcPath is derived from the .hg directory.
+	if data, err := os.ReadFile(hgrcPath); err == nil {
+		existing = string(data)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	updated := addHgrcIgnoreEntry(existing, ignorePath)
+	if updated == existing {
+		return nil
+	}
+	return os.WriteFile(hgrcPath, []byte(updated), 0o600)
+}
+
+func unregisterHgIgnore(hgrcPath string) error {
+	// #nosec G304 -- hgrcPath is derived from the .hg directory.
+	data, err := os.ReadFile(hgrcPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	updated := removeHgrcIgnoreEntry(string(data))
+	if updated == string(data) {
+		return nil
+	}
+	if strings.TrimSpace(updated) == "" {
+		return os.Remove(hgrcPath)
+	}
+	return os.WriteFile(hgrcPath, []byte(updated), 0o600)
+}
+
+// addHgrcIgnoreEntry sets ui.ignore.confik in hgrc content, adding a [ui]
+// section when the file has none.
+func addHgrcIgnoreEntry(content, ignorePath string) string {
+	entry := hgrcIgnoreKey + " = " + ignorePath
+	lines := strings.Split(content, "\n")
+	section := ""
+	uiIndex := -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			if section == "ui" && uiIndex < 0 {
+				uiIndex = i
+			}
+			continue
+		}
+		if section == "ui" && isHgrcIgnoreEntry(trimmed) {
+			if trimmed == entry {
+				return content
+			}
+			lines[i] = entry
+			return strings.Join(lines, "\n")
+		}
+	}
+
+	if uiIndex >= 0 {
+		out := append([]string{}, lines[:uiIndex+1]...)
+		out = append(out, entry)
+		out = append(out, lines[uiIndex+1:]...)
+		return strings.Join(out, "\n")
+	}
+
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	if content != "" {
+		content += "\n"
+	}
+	return content + "[ui]\n" + entry + "\n"
+}
+
+// removeHgrcIgnoreEntry drops ui.ignore.confik and removes a [ui] section
+// that is left empty afterwards.
+func removeHgrcIgnoreEntry(content string) string {
+	lines := strings.Split(content, "\n")
+	out := []string{}
+	section := ""
+	removed := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+		}
+		if section == "ui" && isHgrcIgnoreEntry(trimmed) {
+			removed = true
+			continue
+		}
+		out = append(out, line)
+	}
+	if !removed {
+		return content
+	}
+
+	compacted := []string{}
+	for i := 0; i < len(out); i++ {
+		if strings.TrimSpace(out[i]) == "[ui]" {
+			j := i + 1
+			for j < len(out) && strings.TrimSpace(out[j]) == "" {
+				j++
+			}
+			if j == len(out) || strings.HasPrefix(strings.TrimSpace(out[j]), "[") {
+				for len(compacted) > 0 && strings.TrimSpace(compacted[len(compacted)-1]) == "" {
+					compacted = compacted[:len(compacted)-1]
+				}
+				if j < len(out) && len(compacted) > 0 {
+					compacted = append(compacted, "")
+				}
+				i = j - 1
+				continue
+			}
+		}
+		compacted = append(compacted, out[i])
+	}
+
+	result := strings.Join(compacted, "\n")
+	if strings.HasSuffix(content, "\n") && result != "" && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	return result
+}
+
+func isHgrcIgnoreEntry(line string) bool {
+	key, _, ok := strings.Cut(line, "=")
+	return ok && strings.TrimSpace(key) == hgrcIgnoreKey
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFindVCSRoot(t *testing.T) {
+	base := t.TempDir()
+	hgRoot := filepath.Join(base, "hgrepo")
+	subDir := filepath.Join(hgRoot, "a", "b")
+	if err := os.MkdirAll(filepath.Join(hgRoot, ".hg"), 0o755); err != nil {
+		t.Fatalf("mkdir .hg: %v", err)
+	}
+	if err := os.MkdirAll(subDir, 0o755); err != nil {
+		t.Fatalf("mkdir subdir: %v", err)
+	}
+
+	root, kind := findVCSRoot(subDir)
+	if root != hgRoot || kind != vcsMercurial {
+		t.Fatalf("unexpected vcs root: %q (%s)", root, kind)
+	}
+
+	nestedGit := filepath.Join(hgRoot, "a")
+	if err := os.MkdirAll(filepath.Join(nestedGit, ".git"), 0o755); err != nil {
+		t.Fatalf("mkdir .git: %v", err)
+	}
+	root, kind = findVCSRoot(subDir)
+	if root != nestedGit || kind != vcsGit {
+		t.Fatalf("expected nearest repository to win, got %q (%s)", root, kind)
+	}
+
+	if root, kind := findVCSRoot(t.TempDir()); root != "" || kind != "" {
+		t.Fatalf("expected no repository, got %q (%s)", root, kind)
+	}
+}
+
+func TestHgrcIgnoreEntry(t *testing.T) {
+	t.Run("adds-ui-section", func(t *testing.T) {
+		content := "[paths]\ndefault = https://example.com/repo\n"
+		updated := addHgrcIgnoreEntry(content, "/repo/.hg/confik-ignore")
+		if !strings.Contains(updated, "[ui]\nignore.confik = /repo/.hg/confik-ignore\n") {
+			t.Fatalf("expected ui section with entry, got %q", updated)
+		}
+		if got := removeHgrcIgnoreEntry(updated); got != content {
+			t.Fatalf("expected original hgrc after removal, got %q", got)
+		}
+	})
+
+	t.Run("reuses-existing-ui-section", func(t *testing.T) {
+		content := "[ui]\nusername = Dev <dev@example.com>\n\n[extensions]\nrebase =\n"
+		updated := addHgrcIgnoreEntry(content, "/x/confik-ignore")
+		if strings.Count(updated, "[ui]") != 1 {
+			t.Fatalf("expected a single ui section, got %q", updated)
+		}
+		if !strings.Contains(updated, "[ui]\nignore.confik = /x/confik-ignore\nusername") {
+			t.Fatalf("expected entry at top of ui section, got %q", updated)
+		}
+		if again := addHgrcIgnoreEntry(updated, "/x/confik-ignore"); again != updated {
+			t.Fatalf("expected idempotent add, got %q", again)
+		}
+		if got := removeHgrcIgnoreEntry(updated); got != content {
+			t.Fatalf("expected original hgrc after removal, got %q", got)
+		}
+	})
+
+	t.Run("empty-file", func(t *testing.T) {
+		updated := addHgrcIgnoreEntry("", "/x/confik-ignore")
+		if updated != "[ui]\nignore.confik = /x/confik-ignore\n" {
+			t.Fatalf("unexpected hgrc: %q", updated)
+		}
+		if got := removeHgrcIgnoreEntry(updated); strings.TrimSpace(got) != "" {
+			t.Fatalf("expected empty hgrc after removal, got %q", got)
+		}
+	})
+}
+
+func TestHgIgnoreLifecycle(t *testing.T) {
+	root := t.TempDir()
+	hgDir := filepath.Join(root, ".hg")
+	if err := os.MkdirAll(hgDir, 0o755); err != nil {
+		t.Fatalf("mkdir .hg: %v", err)
+	}
+	hgrcPath := filepath.Join(hgDir, "hgrc")
+	original := "[paths]\ndefault = ../upstream\n"
+	if err := os.WriteFile(hgrcPath, []byte(original), 0o644); err != nil {
+		t.Fatalf("write hgrc: %v", err)
+	}
+
+	first := applyHgIgnore(root, "one", []string{filepath.Join(root, "vite.config.ts")})
+	second := applyHgIgnore(root, "two", []string{filepath.Join(root, "pkg", "a.json")})
+	if first == nil || second == nil {
+		t.Fatalf("expected hg contexts")
+	}
+
+	data, err := os.ReadFile(first.IgnorePath)
+	if err != nil {
+		t.Fatalf("read ignore file: %v", err)
+	}
+	content := string(data)
+	if !strings.HasPrefix(content, hgIgnoreHeader) {
+		t.Fatalf("expected regexp syntax header, got %q", content)
+	}
+	if !strings.Contains(content, `^vite\.config\.ts$`) || !strings.Contains(content, `^pkg/a\.json$`) {
+		t.Fatalf("expected anchored patterns, got %q", content)
+	}
+
+	if err := removeHgIgnoreBlock(first); err != nil {
+		t.Fatalf("removeHgIgnoreBlock error: %v", err)
+	}
+	if !exists(first.IgnorePath) {
+		t.Fatalf("expected ignore file to remain while another run is active")
+	}
+	hgrc, _ := os.ReadFile(hgrcPath)
+	if !strings.Contains(string(hgrc), hgrcIgnoreKey) {
+		t.Fatalf("expected hgrc entry to remain while another run is active")
+	}
+
+	if err := removeHgIgnoreBlock(second); err != nil {
+		t.Fatalf("removeHgIgnoreBlock error: %v", err)
+	}
+	if exists(first.IgnorePath) {
+		t.Fatalf("expected ignore file to be removed")
+	}
+	hgrc, _ = os.ReadFile(hgrcPath)
+	if string(hgrc) != original {
+		t.Fatalf("expected hgrc restored, got %q", hgrc)
+	}
+}
+
+func TestMercurialStagingAndClean(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh to observe staged files")
+	}
+
+	dir := t.TempDir()
+	hgDir := filepath.Join(dir, ".hg")
+	configDir := filepath.Join(dir, ".config")
+	for _, d := range []string{hgDir, configDir} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", d, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	code, _, stderr := runConfik(t, dir, "sh", "-c", "cp .hg/hgrc hgrc.copy && cp .hg/"+hgIgnoreFilename+" ignore.copy")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	hgrc, err := os.ReadFile(filepath.Join(dir, "hgrc.copy"))
+	if err != nil || !strings.Contains(string(hgrc), hgrcIgnoreKey) {
+		t.Fatalf("expected hgrc to register ignore file during run (%v): %q", err, hgrc)
+	}
+	ignore, err := os.ReadFile(filepath.Join(dir, "ignore.copy"))
+	if err != nil || !strings.Contains(string(ignore), `^example\.txt$`) {
+		t.Fatalf("expected staged file in ignore file (%v): %q", err, ignore)
+	}
+	if exists(filepath.Join(hgDir, "hgrc")) || exists(filepath.Join(hgDir, hgIgnoreFilename)) {
+		t.Fatalf("expected hg registration to be reverted after run")
+	}
+
+	if applyHgIgnore(dir, "crashed", []string{filepath.Join(dir, "example.txt")}) == nil {
+		t.Fatalf("expected hg context")
+	}
+	code, _, _ = runConfik(t, dir, "--clean")
+	if code != 0 {
+		t.Fatalf("expected clean to succeed, got %d", code)
+	}
+	if exists(filepath.Join(hgDir, "hgrc")) || exists(filepath.Join(hgDir, hgIgnoreFilename)) {
+		t.Fatalf("expected --clean to remove hg registration")
+	}
+}
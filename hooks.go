@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	hookBlockStart = "# confik:hook:start"
+	hookBlockEnd   = "# confik:hook:end"
+	hookName       = "pre-commit"
+)
+
+// hookBlock is inserted into the pre-commit hook. It prefers a confik on PATH and
+// falls back to the npm-installed binary so the guard works without a global install.
+const hookBlock = hookBlockStart + `
+confik_bin=confik
+if ! command -v "$confik_bin" >/dev/null 2>&1; then
+  confik_bin="$(git rev-parse --show-toplevel)/node_modules/.bin/confik"
+fi
+if [ -x "$confik_bin" ] || command -v "$confik_bin" >/dev/null 2>&1; then
+  "$confik_bin" hooks check || exit 1
+fi
+` + hookBlockEnd + "\n"
+
+func runHooksCommand(cwd string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: confik hooks <install|uninstall|check>")
+	}
+
+	gitRoot := findGitRoot(cwd)
+	if gitRoot == "" {
+		return errors.New("not inside a git repository")
+	}
+
+	switch args[0] {
+	case "install":
+		hookPath, err := resolveHookPath(gitRoot)
+		if err != nil {
+			return err
+		}
+		changed, err := installHook(hookPath)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			_, _ = fmt.Fprintf(os.Stdout, "confik: pre-commit guard already installed in %s\n", hookPath)
+			return nil
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "confik: installed pre-commit guard in %s\n", hookPath)
+		if isLefthookHook(hookPath) {
+			fmt.Fprintln(os.Stderr, "confik: this hook is managed by lefthook; add `confik hooks check` to lefthook.yml so `lefthook install` keeps the guard")
+		}
+		return nil
+	case "uninstall":
+		hookPath, err := resolveHookPath(gitRoot)
+		if err != nil {
+			return err
+		}
+		changed, err := uninstallHook(hookPath)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			_, _ = fmt.Fprintln(os.Stdout, "confik: no pre-commit guard installed")
+			return nil
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "confik: removed pre-commit guard from %s\n", hookPath)
+		return nil
+	case "check":
+		committed, err := findCommittedStagedFiles(gitRoot)
+		if err != nil {
+			return err
+		}
+		if len(committed) == 0 {
+			return nil
+		}
+		fmt.Fprintln(os.Stderr, "confik: refusing to commit files staged from .config/ by a running confik session:")
+		for _, rel := range committed {
+			fmt.Fprintf(os.Stderr, "  %s\n", rel)
+		}
+		fmt.Fprintln(os.Stderr, "confik: unstage them with `git restore --staged <path>` and commit again")
+		return errors.New("commit contains confik staged files")
+	default:
+		return fmt.Errorf("unknown hooks command: %s", args[0])
+	}
+}
+
+// resolveHookPath returns the pre-commit hook location, honouring core.hooksPath.
+// Husky points core.hooksPath at .husky/_ and regenerates that directory, so the
+// guard goes into the user-owned .husky/pre-commit script instead.
+func resolveHookPath(gitRoot string) (string, error) {
+	hooksDir := ""
+	// #nosec G204 -- fixed git arguments; gitRoot comes from repository root traversal.
+	out, err := outputOwnChild(exec.Command("git", "-C", gitRoot, "rev-parse", "--git-path", "hooks"))
+	if err == nil {
+		hooksDir = strings.TrimSpace(string(out))
+		if hooksDir != "" && !filepath.IsAbs(hooksDir) {
+			hooksDir = filepath.Join(gitRoot, hooksDir)
+		}
+	}
+	if hooksDir == "" {
+		gitDir, err := resolveGitDir(gitRoot)
+		if err != nil {
+			return "", err
+		}
+		hooksDir = filepath.Join(gitDir, "hooks")
+	}
+
+	if filepath.Base(hooksDir) == "_" && filepath.Base(filepath.Dir(hooksDir)) == ".husky" {
+		hooksDir = filepath.Dir(hooksDir)
+	}
+	return filepath.Join(hooksDir, hookName), nil
+}
+
+func installHook(hookPath string) (bool, error) {
+	existing := ""
+	// #nosec G304 -- hookPath is resolved from the git hooks directory.
+	if data, err := os.ReadFile(hookPath); err == nil {
+		existing = string(data)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	if strings.Contains(existing, hookBlockStart) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(hookPath), 0o750); err != nil {
+		return false, err
+	}
+
+	if interpreter := hookInterpreter(existing); !shellInterpreters[interpreter] {
+		return false, fmt.Errorf("%s is a %s script, which the sh guard cannot be added to; run `confik hooks check` from it instead", hookPath, interpreter)
+	}
+
+	updated := insertHookBlock(existing)
+	// #nosec G306 -- git hooks must be executable.
+	if err := os.WriteFile(hookPath, []byte(updated), 0o755); err != nil {
+		return false, err
+	}
+	// WriteFile keeps the mode of an existing file; make sure chained hooks stay executable.
+	if err := os.Chmod(hookPath, 0o755); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func uninstallHook(hookPath string) (bool, error) {
+	// #nosec G304 -- hookPath is resolved from the git hooks directory.
+	data, err := os.ReadFile(hookPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	content := string(data)
+	if !strings.Contains(content, hookBlockStart) {
+		return false, nil
+	}
+
+	updated := removeHookBlock(content)
+	if isEmptyHook(updated) {
+		return true, os.Remove(hookPath)
+	}
+	return true, os.WriteFile(hookPath, []byte(updated), 0o755) // #nosec G306 -- git hooks must be executable.
+}
+
+// shellInterpreters run the sh guard block as part of an existing hook.
+var shellInterpreters = map[string]bool{"sh": true, "bash": true, "dash": true, "ash": true, "ksh": true, "zsh": true}
+
+// hookInterpreter returns the program named by a hook's shebang, looking
+// through env. A hook without one is run by sh.
+func hookInterpreter(content string) string {
+	if !strings.HasPrefix(content, "#!") {
+		return "sh"
+	}
+	line, _, _ := strings.Cut(content[2:], "\n")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "sh"
+	}
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" {
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				return path.Base(field)
+			}
+		}
+	}
+	return interpreter
+}
+
+// insertHookBlock places the guard right after the shebang so it runs before
+// any existing hook body that might exit early.
+func insertHookBlock(content string) string {
+	if content == "" {
+		return "#!/bin/sh\n" + hookBlock
+	}
+	if strings.HasPrefix(content, "#!") {
+		newline := strings.Index(content, "\n")
+		if newline < 0 {
+			return content + "\n" + hookBlock
+		}
+		return content[:newline+1] + hookBlock + content[newline+1:]
+	}
+	return hookBlock + content
+}
+
+func removeHookBlock(content string) string {
+	lines := strings.Split(content, "\n")
+	out := []string{}
+	skipping := false
+	for _, line := range lines {
+		if line == hookBlockStart {
+			skipping = true
+			continue
+		}
+		if skipping {
+			if line == hookBlockEnd {
+				skipping = false
+			}
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
+
+func isEmptyHook(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#!") {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func isLefthookHook(hookPath string) bool {
+	// #nosec G304 -- hookPath is resolved from the git hooks directory.
+	data, err := os.ReadFile(hookPath)
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(data, []byte("lefthook"))
+}
+
+// findCommittedStagedFiles returns index entries (relative to gitRoot) that a live
+// confik manifest lists as staged. Manifests are looked up in every ancestor
+// directory of each path, so nested packages in a monorepo are covered.
+func findCommittedStagedFiles(gitRoot string) ([]string, error) {
+	// #nosec G204 -- fixed git arguments; gitRoot comes from repository root traversal.
+	out, err := outputOwnChild(exec.Command("git", "-C", gitRoot, "diff", "--cached", "--name-only", "-z", "--diff-filter=ACMR"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list staged files (%v)", err)
+	}
+
+	manifests := map[string]map[string]bool{}
+	stagedIn := func(projectDir string) map[string]bool {
+		if files, ok := manifests[projectDir]; ok {
+			return files
+		}
+		files := map[string]bool{}
+		if !isDirectory(filepath.Join(projectDir, ".config")) {
+			manifests[projectDir] = files
+			return files
+		}
+		// A manifest left behind by a run that crashed stages nothing anymore:
+		// the files it lists may since have been committed on purpose.
+		manifest, err := readManifest(projectManifestPath(projectDir))
+		if err == nil && len(liveParticipants(manifest.Participants)) > 0 {
+			for _, rel := range manifest.CreatedFiles {
+				files[filepath.ToSlash(rel)] = true
+			}
+		}
+		manifests[projectDir] = files
+		return files
+	}
+
+	committed := []string{}
+	for _, entry := range strings.Split(string(out), "\x00") {
+		if entry == "" {
+			continue
+		}
+		absPath := filepath.Join(gitRoot, filepath.FromSlash(entry))
+		for dir := filepath.Dir(absPath); ; dir = filepath.Dir(dir) {
+			rel, err := filepath.Rel(dir, absPath)
+			if err == nil && stagedIn(dir)[filepath.ToSlash(rel)] {
+				committed = append(committed, entry)
+				break
+			}
+			if dir == gitRoot || dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+	sort.Strings(committed)
+	return committed, nil
+}
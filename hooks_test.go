@@ -0,0 +1,289 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func initGitRepo(t *testing.T, dir string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary not available")
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"config", "user.email", "confik@example.com"},
+		{"config", "user.name", "confik"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v (%s)", args, err, out)
+		}
+	}
+}
+
+func runGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v (%s)", args, err, out)
+	}
+}
+
+func TestHookBlockHelpers(t *testing.T) {
+	t.Run("new-hook", func(t *testing.T) {
+		content := insertHookBlock("")
+		if !strings.HasPrefix(content, "#!/bin/sh\n"+hookBlockStart) {
+			t.Fatalf("expected shebang followed by block, got %q", content)
+		}
+		if !isEmptyHook(removeHookBlock(content)) {
+			t.Fatalf("expected hook to be empty after removing block")
+		}
+	})
+
+	t.Run("chains-after-shebang", func(t *testing.T) {
+		existing := "#!/usr/bin/env bash\nnpx lint-staged\nexit 0\n"
+		content := insertHookBlock(existing)
+		if !strings.HasPrefix(content, "#!/usr/bin/env bash\n"+hookBlockStart) {
+			t.Fatalf("expected block after shebang, got %q", content)
+		}
+		if !strings.HasSuffix(content, "npx lint-staged\nexit 0\n") {
+			t.Fatalf("expected existing body to be preserved, got %q", content)
+		}
+		if got := removeHookBlock(content); got != existing {
+			t.Fatalf("expected original hook after removal, got %q", got)
+		}
+	})
+
+	t.Run("no-shebang", func(t *testing.T) {
+		existing := "npx lint-staged\n"
+		content := insertHookBlock(existing)
+		if got := removeHookBlock(content); got != existing {
+			t.Fatalf("expected original hook after removal, got %q", got)
+		}
+		if isEmptyHook(existing) {
+			t.Fatalf("expected hook with commands to be non-empty")
+		}
+	})
+}
+
+func TestHooksInstallAndUninstall(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook permissions are not meaningful on windows")
+	}
+
+	t.Run("creates-and-removes-hook", func(t *testing.T) {
+		root := t.TempDir()
+		initGitRepo(t, root)
+
+		hookPath, err := resolveHookPath(root)
+		if err != nil {
+			t.Fatalf("resolveHookPath error: %v", err)
+		}
+		if want := filepath.Join(root, ".git", "hooks", hookName); hookPath != want {
+			t.Fatalf("unexpected hook path: got %q want %q", hookPath, want)
+		}
+
+		changed, err := installHook(hookPath)
+		if err != nil || !changed {
+			t.Fatalf("installHook = %v, %v", changed, err)
+		}
+		info, err := os.Stat(hookPath)
+		if err != nil {
+			t.Fatalf("stat hook: %v", err)
+		}
+		if info.Mode().Perm()&0o100 == 0 {
+			t.Fatalf("expected hook to be executable, got %v", info.Mode())
+		}
+
+		changed, err = installHook(hookPath)
+		if err != nil || changed {
+			t.Fatalf("expected second install to be a no-op, got %v, %v", changed, err)
+		}
+
+		changed, err = uninstallHook(hookPath)
+		if err != nil || !changed {
+			t.Fatalf("uninstallHook = %v, %v", changed, err)
+		}
+		if _, err := os.Stat(hookPath); err == nil {
+			t.Fatalf("expected hook created by confik to be removed")
+		}
+	})
+
+	t.Run("chains-existing-hook", func(t *testing.T) {
+		root := t.TempDir()
+		initGitRepo(t, root)
+
+		hookPath := filepath.Join(root, ".git", "hooks", hookName)
+		existing := "#!/bin/sh\necho existing\n"
+		if err := os.WriteFile(hookPath, []byte(existing), 0o755); err != nil {
+			t.Fatalf("write hook: %v", err)
+		}
+
+		if _, err := installHook(hookPath); err != nil {
+			t.Fatalf("installHook error: %v", err)
+		}
+		if _, err := uninstallHook(hookPath); err != nil {
+			t.Fatalf("uninstallHook error: %v", err)
+		}
+		data, err := os.ReadFile(hookPath)
+		if err != nil {
+			t.Fatalf("expected existing hook to remain: %v", err)
+		}
+		if string(data) != existing {
+			t.Fatalf("expected existing hook restored, got %q", data)
+		}
+	})
+
+	t.Run("refuses-non-shell-hook", func(t *testing.T) {
+		root := t.TempDir()
+		initGitRepo(t, root)
+
+		hookPath := filepath.Join(root, ".git", "hooks", hookName)
+		existing := "#!/usr/bin/env node\nconsole.log('existing')\n"
+		if err := os.WriteFile(hookPath, []byte(existing), 0o755); err != nil {
+			t.Fatalf("write hook: %v", err)
+		}
+
+		if _, err := installHook(hookPath); err == nil || !strings.Contains(err.Error(), "node script") {
+			t.Fatalf("expected a node hook to be refused, got %v", err)
+		}
+		if data, err := os.ReadFile(hookPath); err != nil || string(data) != existing {
+			t.Fatalf("expected the node hook to be left alone, got %q (%v)", data, err)
+		}
+	})
+
+	t.Run("honours-core-hooks-path", func(t *testing.T) {
+		root := t.TempDir()
+		initGitRepo(t, root)
+		runGit(t, root, "config", "core.hooksPath", "custom-hooks")
+
+		hookPath, err := resolveHookPath(root)
+		if err != nil {
+			t.Fatalf("resolveHookPath error: %v", err)
+		}
+		if want := filepath.Join(root, "custom-hooks", hookName); hookPath != want {
+			t.Fatalf("unexpected hook path: got %q want %q", hookPath, want)
+		}
+	})
+
+	t.Run("husky-user-hook", func(t *testing.T) {
+		root := t.TempDir()
+		initGitRepo(t, root)
+		runGit(t, root, "config", "core.hooksPath", ".husky/_")
+
+		hookPath, err := resolveHookPath(root)
+		if err != nil {
+			t.Fatalf("resolveHookPath error: %v", err)
+		}
+		if want := filepath.Join(root, ".husky", hookName); hookPath != want {
+			t.Fatalf("unexpected hook path: got %q want %q", hookPath, want)
+		}
+	})
+}
+
+func TestFindCommittedStagedFiles(t *testing.T) {
+	root := t.TempDir()
+	initGitRepo(t, root)
+
+	pkgDir := filepath.Join(root, "packages", "app")
+	configDir := filepath.Join(pkgDir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	for _, name := range []string{"staged.config.js", "own.js"} {
+		if err := os.WriteFile(filepath.Join(pkgDir, name), []byte("x"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	manifest := Manifest{RunID: "run1", CreatedFiles: []string{"staged.config.js"}, Participants: []Participant{{PID: os.Getpid()}}}
+	if err := writeManifest(filepath.Join(configDir, manifestFilename), manifest); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+
+	runGit(t, root, "add", "packages/app/own.js")
+	committed, err := findCommittedStagedFiles(root)
+	if err != nil {
+		t.Fatalf("findCommittedStagedFiles error: %v", err)
+	}
+	if len(committed) != 0 {
+		t.Fatalf("expected no staged confik files, got %v", committed)
+	}
+
+	runGit(t, root, "add", "packages/app/staged.config.js")
+	committed, err = findCommittedStagedFiles(root)
+	if err != nil {
+		t.Fatalf("findCommittedStagedFiles error: %v", err)
+	}
+	if len(committed) != 1 || committed[0] != "packages/app/staged.config.js" {
+		t.Fatalf("unexpected staged confik files: %v", committed)
+	}
+
+	// A manifest left behind by a crashed run no longer guards its files.
+	manifest.Participants = []Participant{{PID: deadPID(t)}}
+	if err := writeManifest(filepath.Join(configDir, manifestFilename), manifest); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	committed, err = findCommittedStagedFiles(root)
+	if err != nil {
+		t.Fatalf("findCommittedStagedFiles error: %v", err)
+	}
+	if len(committed) != 0 {
+		t.Fatalf("expected a stale manifest to be ignored, got %v", committed)
+	}
+}
+
+func TestHooksCheckEndToEnd(t *testing.T) {
+	dir := t.TempDir()
+	initGitRepo(t, dir)
+
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "eslint.config.js"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("write staged file: %v", err)
+	}
+	manifest := Manifest{RunID: "run1", CreatedFiles: []string{"eslint.config.js"}, Participants: []Participant{{PID: os.Getpid()}}}
+	if err := writeManifest(filepath.Join(configDir, manifestFilename), manifest); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+
+	code, _, _ := runConfik(t, dir, "hooks", "check")
+	if code != 0 {
+		t.Fatalf("expected clean index to pass, got %d", code)
+	}
+
+	runGit(t, dir, "add", "-f", "eslint.config.js")
+	code, _, stderr := runConfik(t, dir, "hooks", "check")
+	if code == 0 {
+		t.Fatalf("expected check to fail when a staged file is in the index")
+	}
+	if !strings.Contains(stderr, "eslint.config.js") {
+		t.Fatalf("expected offending path in output, got: %s", stderr)
+	}
+}
+
+func TestHookInterpreter(t *testing.T) {
+	cases := map[string]string{
+		"":                               "sh",
+		"echo no shebang\n":              "sh",
+		"#!/bin/sh\n":                    "sh",
+		"#!/bin/bash -e\n":               "bash",
+		"#!/usr/bin/env bash\n":          "bash",
+		"#!/usr/bin/env -S node --x\n":   "node",
+		"#!/usr/bin/env python3\r\n":     "python3",
+		"#!/usr/local/bin/python\nx=1\n": "python",
+	}
+	for content, want := range cases {
+		if got := hookInterpreter(content); got != want {
+			t.Fatalf("hookInterpreter(%q) = %q, want %q", content, got, want)
+		}
+	}
+}
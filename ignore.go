@@ -0,0 +1,118 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// ignoreFilename lists exclude patterns in gitignore syntax, next to
+// confik.json.
+const ignoreFilename = ".confikignore"
+
+// ignoreRule is one compiled gitignore pattern.
+type ignoreRule struct {
+	// pattern is matched against the whole path relative to .config/.
+	pattern string
+	negate  bool
+	// dirOnly rules (written with a trailing slash) only match directories.
+	dirOnly bool
+}
+
+// ignoreMatcher matches paths the way git matches .gitignore rules: the last
+// rule that matches a path decides, "!" re-includes, a trailing slash limits
+// a rule to directories, and a pattern is anchored to .config/ when it has a
+// slash anywhere but at the end. A file below an ignored directory is
+// ignored, whatever the later rules say about the file itself.
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+func compileIgnore(patterns []string) ignoreMatcher {
+	return ignoreMatcher{}.with(patterns)
+}
+
+// with returns a matcher with patterns added after the existing rules. The
+// receiver is left unchanged.
+func (m ignoreMatcher) with(patterns []string) ignoreMatcher {
+	rules := append([]ignoreRule(nil), m.rules...)
+	for _, pattern := range patterns {
+		if rule, ok := compileIgnoreRule(pattern); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return ignoreMatcher{rules: rules}
+}
+
+func compileIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	if strings.Contains(line, "/") {
+		line = strings.TrimLeft(line, "/")
+	} else {
+		line = "**/" + line
+	}
+	if strings.HasSuffix(line, "/**") {
+		// doublestar lets a trailing /** match the directory itself; in git
+		// it only matches what is inside.
+		line += "/*"
+	}
+	// Patterns always use "/": a backslash escapes the next character, as in
+	// git, on every platform.
+	rule.pattern = line
+	return rule, true
+}
+
+// matches reports whether the file at relPosix, relative to .config/, is
+// ignored.
+func (m ignoreMatcher) matches(relPosix string) bool {
+	if len(m.rules) == 0 {
+		return false
+	}
+	relPosix = strings.Trim(filepath.ToSlash(relPosix), "/")
+	for i := 0; i < len(relPosix); i++ {
+		if relPosix[i] == '/' && m.decide(relPosix[:i], true) {
+			return true
+		}
+	}
+	return m.decide(relPosix, false)
+}
+
+func (m ignoreMatcher) decide(relPosix string, isDir bool) bool {
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if ok, _ := doublestar.Match(rule.pattern, relPosix); ok {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// parseIgnoreFile splits a .confikignore file into its pattern lines.
+func parseIgnoreFile(data []byte) []string {
+	return strings.Split(strings.TrimPrefix(string(data), "\ufeff"), "\n")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		target   string
+		want     bool
+	}{
+		{[]string{"*.local"}, "a.local", true},
+		{[]string{"*.local"}, "deep/nested/a.local", true},
+		{[]string{"**/*.local"}, "deep/a.local", true},
+		{[]string{"/a.local"}, "a.local", true},
+		{[]string{"/a.local"}, "sub/a.local", false},
+		{[]string{"sub/a.txt"}, "sub/a.txt", true},
+		{[]string{"sub/a.txt"}, "other/sub/a.txt", false},
+		{[]string{"private"}, "private/secret.txt", true},
+		{[]string{"private/"}, "private/secret.txt", true},
+		{[]string{"private/"}, "private", false},
+		{[]string{"private/"}, "nested/private/key", true},
+		{[]string{"/private/"}, "nested/private/key", false},
+		{[]string{"*.txt", "!keep.txt"}, "keep.txt", false},
+		{[]string{"*.txt", "!keep.txt"}, "drop.txt", true},
+		{[]string{"!keep.txt", "*.txt"}, "keep.txt", true},
+		{[]string{"private/**", "!private/keep.txt"}, "private/keep.txt", false},
+		{[]string{"private/**", "!private/keep.txt"}, "private/drop.txt", true},
+		{[]string{"private/", "!private/keep.txt"}, "private/keep.txt", true},
+		{[]string{"a/**/b.txt"}, "a/b.txt", true},
+		{[]string{"a/**/b.txt"}, "a/x/y/b.txt", true},
+		{[]string{"# comment", ""}, "# comment", false},
+		{[]string{`\#hash`}, "#hash", true},
+		{[]string{`\!bang`}, "!bang", true},
+		{[]string{"trailing.txt   "}, "trailing.txt", true},
+		{[]string{"["}, "[", false},
+		{[]string{`\*.txt`}, "*.txt", true},
+		{[]string{`\*.txt`}, "a.txt", false},
+		{[]string{`with\ `}, "with ", true},
+		{[]string{`sub\a.txt`}, "sub/a.txt", false},
+	}
+	for _, tc := range cases {
+		if got := compileIgnore(tc.patterns).matches(tc.target); got != tc.want {
+			t.Fatalf("compileIgnore(%q).matches(%q) = %v, want %v", tc.patterns, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestIgnoreMatcherWithLeavesReceiverAlone(t *testing.T) {
+	base := compileIgnore([]string{"*.txt"})
+	extended := base.with([]string{"!keep.txt"})
+	if !base.matches("keep.txt") || extended.matches("keep.txt") {
+		t.Fatalf("expected with to return a new matcher")
+	}
+}
+
+func TestConfikIgnoreFile(t *testing.T) {
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(filepath.Join(configDir, "private"), 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	ignore := "# local files\r\n*.local\n!shared.local\nprivate/\n"
+	if err := os.WriteFile(filepath.Join(configDir, ignoreFilename), []byte(ignore), 0o644); err != nil {
+		t.Fatalf("write %s: %v", ignoreFilename, err)
+	}
+	cfg := `{"exclude":["!mine.local"]}`
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	for _, file := range []string{"keep.txt", "drop.local", "shared.local", "mine.local", "private/key"} {
+		if err := os.WriteFile(filepath.Join(configDir, file), []byte(file), 0o644); err != nil {
+			t.Fatalf("write %s: %v", file, err)
+		}
+	}
+
+	code, stdout, stderr := runConfik(t, dir, append([]string{"--dry-run"}, testCommandArgs(0)...)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "would stage 3 file") || !strings.Contains(stdout, "excluded 2 file") {
+		t.Fatalf("expected keep.txt, shared.local and mine.local to be staged, got: %s", stdout)
+	}
+
+	code, stdout, stderr = runConfik(t, dir, testCommandArgs(0)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "staged 3 file") || exists(filepath.Join(dir, ignoreFilename)) {
+		t.Fatalf("expected %s itself not to be staged, got: %s", ignoreFilename, stdout)
+	}
+}
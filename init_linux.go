@@ -0,0 +1,71 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// initForwardedSignals are passed on to the command in --init mode: every
+// signal a process can catch, apart from SIGCHLD. PID 1 gets no default action
+// for signals it does not handle, so without forwarding `docker stop` would
+// only ever end with a SIGKILL, and a stop signal would be lost altogether.
+var initForwardedSignals = []os.Signal{
+	syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM,
+	syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH, syscall.SIGALRM,
+	syscall.SIGCONT, syscall.SIGPWR, syscall.SIGTSTP, syscall.SIGTTIN,
+	syscall.SIGTTOU, syscall.SIGPIPE, syscall.SIGURG, syscall.SIGPROF,
+	syscall.SIGXCPU, syscall.SIGXFSZ, syscall.SIGVTALRM,
+}
+
+// notifyInit subscribes to the signals waitAsInit handles. It is called before
+// the command starts, so that a signal the command sends to PID 1 right away is
+// not lost.
+func notifyInit() chan os.Signal {
+	sigCh := make(chan os.Signal, 32)
+	signal.Notify(sigCh, append([]os.Signal{syscall.SIGCHLD}, initForwardedSignals...)...)
+	return sigCh
+}
+
+// waitAsInit supervises the started cmd like tini: forwarded signals go to the
+// command and every orphan reparented to confik is reaped. confik's own
+// children, such as git during a watch resync, are left to the code waiting
+// for them. It returns once the command itself has exited.
+func waitAsInit(cmd *exec.Cmd, group *processGroup, sigCh chan os.Signal) (int, error) {
+	// Children that exited before SIGCHLD was subscribed are picked up by the
+	// first non-blocking reap below.
+	pid := cmd.Process.Pid
+	for {
+		reapChildren()
+		var status unix.WaitStatus
+		reaped, err := unix.Wait4(pid, &status, unix.WNOHANG, nil)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return 1, err
+		}
+		if reaped == pid {
+			// The command was reaped here rather than by cmd.Wait.
+			_ = cmd.Process.Release()
+			return exitCode(syscall.WaitStatus(status)), nil
+		}
+
+		sig := <-sigCh
+		if sig == syscall.SIGCHLD {
+			continue
+		}
+		switch sig {
+		case syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM:
+			group.stop(sig)
+		default:
+			group.signal(sig)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// runConfikAsInit runs confik as PID 1 of a fresh PID namespace, the way a
+// container runtime starts its entrypoint.
+func runConfikAsInit(t *testing.T, dir string, args ...string) (int, string) {
+	t.Helper()
+	if _, err := exec.LookPath("unshare"); err != nil {
+		t.Skip("unshare not available")
+	}
+	prefix := []string{"--pid", "--fork", "--mount-proc"}
+	if os.Geteuid() != 0 {
+		prefix = append([]string{"--user", "--map-root-user"}, prefix...)
+	}
+	if err := exec.Command("unshare", append(prefix, "true")...).Run(); err != nil {
+		t.Skipf("cannot create a PID namespace here: %v", err)
+	}
+
+	cmdArgs := append(prefix, os.Args[0], "-test.run=TestHelperProcess", "--")
+	cmd := exec.Command("unshare", append(cmdArgs, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CONFIK_HELPER=1")
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if err == nil {
+		return 0, output.String()
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), output.String()
+	}
+	t.Fatalf("unexpected error running confik: %v", err)
+	return 1, output.String()
+}
+
+func writeInitProject(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	return dir
+}
+
+func TestInitReapsOrphansAndKeepsExitCode(t *testing.T) {
+	dir := writeInitProject(t)
+
+	// The subshell exits right away, orphaning its sleep onto PID 1. Once that
+	// sleep exits, confik has to reap it or it lingers as a zombie.
+	script := `[ "$PPID" = 1 ] || exit 2
+(sleep 0.1 &)
+sleep 0.5
+if grep -qs ') Z ' /proc/[0-9]*/stat; then exit 3; fi
+test -f example.txt || exit 4
+exit 7`
+	code, output := runConfikAsInit(t, dir, "--init", "sh", "-c", script)
+	if code != 7 {
+		t.Fatalf("expected the command's exit code 7, got %d (output: %s)", code, output)
+	}
+	if exists(filepath.Join(dir, "example.txt")) {
+		t.Fatalf("expected staged file to be cleaned up")
+	}
+}
+
+func TestInitForwardsTerminationAndCleansUp(t *testing.T) {
+	dir := writeInitProject(t)
+
+	// `docker stop` sends SIGTERM to PID 1; confik must pass it on and let the
+	// command exit on its own terms before cleaning up.
+	script := `trap 'touch got-term; exit 0' TERM
+kill -TERM 1
+sleep 5 &
+wait`
+	code, output := runConfikAsInit(t, dir, "--init", "sh", "-c", script)
+	if code != 0 {
+		t.Fatalf("expected clean exit after forwarded SIGTERM, got %d (output: %s)", code, output)
+	}
+	if !exists(filepath.Join(dir, "got-term")) {
+		t.Fatalf("expected command to receive SIGTERM (output: %s)", output)
+	}
+	if exists(filepath.Join(dir, "example.txt")) {
+		t.Fatalf("expected staged file to be cleaned up")
+	}
+}
+
+func TestInitReportsSignalExitCode(t *testing.T) {
+	dir := writeInitProject(t)
+
+	code, output := runConfikAsInit(t, dir, "--init", "sh", "-c", "kill -KILL $$")
+	if code != 128+9 {
+		t.Fatalf("expected exit code 137, got %d (output: %s)", code, output)
+	}
+}
+
+func TestInitForwardsStopAndOtherSignals(t *testing.T) {
+	dir := writeInitProject(t)
+
+	// PID 1 has no default action for these, so they only reach the command
+	// if confik forwards them.
+	script := `trap 'touch got-tstp' TSTP
+trap 'touch got-pipe' PIPE
+trap 'touch got-urg' URG
+kill -TSTP 1
+kill -PIPE 1
+kill -URG 1
+sleep 0.5
+exit 0`
+	code, output := runConfikAsInit(t, dir, "--init", "sh", "-c", script)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (output: %s)", code, output)
+	}
+	for _, name := range []string{"got-tstp", "got-pipe", "got-urg"} {
+		if !exists(filepath.Join(dir, name)) {
+			t.Fatalf("expected command to receive the signal behind %s (output: %s)", name, output)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// notifyInit subscribes to nothing outside Linux.
+func notifyInit() chan os.Signal {
+	return make(chan os.Signal, 1)
+}
+
+// waitAsInit falls back to a plain wait outside Linux, where confik is not
+// expected to run as PID 1.
+func waitAsInit(cmd *exec.Cmd, group *processGroup, sigCh chan os.Signal) (int, error) {
+	fmt.Fprintln(os.Stderr, "confik: --init is only supported on Linux; running the command normally")
+	return waitCommand(cmd)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// InjectRule lets a tool read its config straight from .config/ instead of a
+// staged copy: when confik runs Command and a file matching Pattern is in
+// .config/, its path is passed with Flag or in the environment variable Env.
+type InjectRule struct {
+	Pattern string `json:"pattern"`
+	Command string `json:"command"`
+	Flag    string `json:"flag,omitempty"`
+	Env     string `json:"env,omitempty"`
+}
+
+func (r InjectRule) valid() bool {
+	return r.Pattern != "" && r.Command != "" && (r.Flag == "") != (r.Env == "")
+}
+
+// injection is a rule applied to one file in .config/.
+type injection struct {
+	Rule InjectRule
+	Rel  string
+	Path string
+}
+
+// injectRules returns the rules from confik.json followed by those from the
+// registry. The registry rules are opt-in with injectRegistry: a tool that
+// reads its config from .config/ may resolve paths in it differently than
+// from a staged copy.
+func injectRules(config ConfikConfig, useRegistry bool) []InjectRule {
+	rules := []InjectRule{}
+	for _, rule := range config.Inject {
+		if !rule.valid() {
+			fmt.Fprintf(os.Stderr, "confik: ignoring inject rule for %q in %s (needs pattern, command and one of flag or env)\n", rule.Command, config.Path)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if useRegistry && config.InjectRegistry {
+		rules = append(rules, loadRegistry().Inject...)
+	}
+	return rules
+}
+
+// injectForCommand applies the inject rules for the wrapped command to the
+// files filter would stage or leave to the registry. Files that already exist
+// in the project root are left alone, as they would be when staging.
+func injectForCommand(cwd string, parsed ParsedArgs, config ConfikConfig, useRegistry bool, entries []configEntry, filter stageFilter) (ParsedArgs, []string, []injection) {
+	if parsed.Command == "" || parsed.Flags.Parallel.Enabled {
+		return parsed, nil, nil
+	}
+	candidates := []configEntry{}
+	for _, entry := range entries {
+		switch filter.classify(entry.Rel) {
+		case entryStage, entryRegistry:
+			if !exists(filepath.Join(cwd, filepath.FromSlash(entry.Rel))) {
+				candidates = append(candidates, entry)
+			}
+		}
+	}
+	injections := planInjections(parsed.Command, parsed.CommandArgs, injectRules(config, useRegistry), candidates)
+	parsed, env := applyInjections(parsed, injections)
+	return parsed, env, injections
+}
+
+// planInjections picks, for each rule that applies to command, the first
+// candidate file in .config/ it matches. A rule is left out when the command
+// line already passes the flag or the environment already sets the variable,
+// so that the user's choice wins.
+func planInjections(command string, args []string, rules []InjectRule, candidates []configEntry) []injection {
+	name := commandName(command)
+	sorted := append([]configEntry(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Rel < sorted[j].Rel })
+
+	injections := []injection{}
+	taken := map[string]bool{}
+	for _, rule := range rules {
+		if rule.Command != name {
+			continue
+		}
+		key := "flag:" + rule.Flag
+		if rule.Env != "" {
+			key = "env:" + rule.Env
+			if _, set := os.LookupEnv(rule.Env); set {
+				continue
+			}
+		} else if hasFlag(args, rule.Flag) {
+			continue
+		}
+		if taken[key] {
+			continue
+		}
+		for _, entry := range sorted {
+			if matchesPatternList(entry.Rel, []string{rule.Pattern}, true) {
+				injections = append(injections, injection{Rule: rule, Rel: entry.Rel, Path: entry.Path})
+				taken[key] = true
+				break
+			}
+		}
+	}
+	return injections
+}
+
+// applyInjections inserts the flags right after the program name, ahead of
+// any subcommand or "--", and returns the environment variables to set.
+func applyInjections(parsed ParsedArgs, injections []injection) (ParsedArgs, []string) {
+	flags := []string{}
+	env := []string{}
+	for _, inj := range injections {
+		if inj.Rule.Env != "" {
+			env = append(env, inj.Rule.Env+"="+inj.Path)
+			continue
+		}
+		flags = append(flags, inj.Rule.Flag, inj.Path)
+	}
+	if len(flags) > 0 {
+		parsed.CommandArgs = append(flags, parsed.CommandArgs...)
+	}
+	return parsed, env
+}
+
+func injectedFiles(injections []injection) map[string]bool {
+	files := map[string]bool{}
+	for _, inj := range injections {
+		files[inj.Rel] = true
+	}
+	return files
+}
+
+// commandName is the program name rules are matched against: the base name
+// without a Windows executable extension.
+func commandName(command string) string {
+	name := filepath.Base(command)
+	if runtime.GOOS == "windows" {
+		for _, ext := range []string{".exe", ".cmd", ".bat"} {
+			if strings.HasSuffix(strings.ToLower(name), ext) {
+				return name[:len(name)-len(ext)]
+			}
+		}
+	}
+	return name
+}
+
+func hasFlag(args []string, flag string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		if arg == flag || strings.HasPrefix(arg, flag+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// describeCommandLine renders env assignments and a command line the way
+// they would be typed in a shell.
+func describeCommandLine(env []string, command string, args []string) string {
+	words := []string{}
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		words = append(words, name+"="+shellQuote(value))
+	}
+	words = append(words, shellQuote(command))
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
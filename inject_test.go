@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPlanInjections(t *testing.T) {
+	rules := []InjectRule{
+		{Pattern: "vite.config.*", Command: "vite", Flag: "--config"},
+		{Pattern: ".toolrc", Command: "vite", Env: "CONFIK_TEST_TOOLRC"},
+		{Pattern: "vitest.config.*", Command: "vitest", Flag: "--config"},
+	}
+	candidates := []configEntry{
+		{Rel: "vite.config.ts", Path: "/p/.config/vite.config.ts"},
+		{Rel: "vite.config.js", Path: "/p/.config/vite.config.js"},
+		{Rel: ".toolrc", Path: "/p/.config/.toolrc"},
+		{Rel: "vitest.config.ts", Path: "/p/.config/vitest.config.ts"},
+	}
+
+	injections := planInjections("/usr/local/bin/vite", []string{"build"}, rules, candidates)
+	if len(injections) != 2 || injections[0].Rel != "vite.config.js" || injections[1].Rel != ".toolrc" {
+		t.Fatalf("unexpected injections: %#v", injections)
+	}
+	parsed, env := applyInjections(ParsedArgs{Command: "vite", CommandArgs: []string{"build"}}, injections)
+	if strings.Join(parsed.CommandArgs, " ") != "--config /p/.config/vite.config.js build" {
+		t.Fatalf("unexpected command args: %v", parsed.CommandArgs)
+	}
+	if len(env) != 1 || env[0] != "CONFIK_TEST_TOOLRC=/p/.config/.toolrc" {
+		t.Fatalf("unexpected env: %v", env)
+	}
+
+	if got := planInjections("vite", []string{"--config=mine.ts"}, rules[:1], candidates); len(got) != 0 {
+		t.Fatalf("expected an explicit --config to win, got %#v", got)
+	}
+	t.Setenv("CONFIK_TEST_TOOLRC", "mine")
+	if got := planInjections("vite", nil, rules[1:2], candidates); len(got) != 0 {
+		t.Fatalf("expected an existing environment variable to win, got %#v", got)
+	}
+	if got := planInjections("node", nil, rules, candidates); len(got) != 0 {
+		t.Fatalf("expected no injections for an unrelated command, got %#v", got)
+	}
+}
+
+func TestRegistryInjectRulesAreValid(t *testing.T) {
+	rules := loadRegistry().Inject
+	if len(rules) == 0 {
+		t.Fatalf("expected embedded inject rules")
+	}
+	for _, rule := range rules {
+		if !rule.valid() {
+			t.Fatalf("invalid registry inject rule: %#v", rule)
+		}
+		// Prettier resolves overrides relative to its config file.
+		if rule.Command == "prettier" {
+			t.Fatalf("prettier must not be injected: %#v", rule)
+		}
+	}
+}
+
+func TestInjectPassesConfigInsteadOfStaging(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	binDir := filepath.Join(dir, "node_modules", ".bin")
+	for _, d := range []string{configDir, binDir} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	files := map[string]string{
+		"vite.config.ts": "export default {}",
+		"tool.conf":      "x",
+		"other.txt":      "y",
+		configFilename:   `{"inject":[{"pattern":"tool.conf","command":"vite","env":"TOOL_CONFIG"}]}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(configDir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	script := "#!/bin/sh\n{ echo \"$@\"; echo \"$TOOL_CONFIG\"; ls; } > seen.txt\n"
+	if err := os.WriteFile(filepath.Join(binDir, "vite"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake vite: %v", err)
+	}
+
+	// Built-in rules are opt-in, so by default only the confik.json rule applies.
+	code, stdout, stderr := runConfik(t, dir, "--dry-run", "vite", "build")
+	if code != 0 {
+		t.Fatalf("dry-run failed with %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "would run: TOOL_CONFIG="+filepath.Join(configDir, "tool.conf")+" vite build") || !strings.Contains(stdout, "would stage 2 file(s)") {
+		t.Fatalf("expected vite.config.ts to be staged without injectRegistry, got: %s", stdout)
+	}
+
+	withRegistry := `{"injectRegistry":true,"inject":[{"pattern":"tool.conf","command":"vite","env":"TOOL_CONFIG"}]}`
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(withRegistry), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	code, stdout, stderr = runConfik(t, dir, "--dry-run", "vite", "build")
+	if code != 0 {
+		t.Fatalf("dry-run failed with %d (stderr: %s)", code, stderr)
+	}
+	wantLine := "would run: TOOL_CONFIG=" + filepath.Join(configDir, "tool.conf") + " vite --config " + filepath.Join(configDir, "vite.config.ts") + " build"
+	if !strings.Contains(stdout, wantLine) || !strings.Contains(stdout, "would pass 2 file(s)") {
+		t.Fatalf("expected rewritten command in dry-run output, got: %s", stdout)
+	}
+
+	code, _, stderr = runConfik(t, dir, "vite", "build")
+	if code != 0 {
+		t.Fatalf("run failed with %d (stderr: %s)", code, stderr)
+	}
+	seen, err := os.ReadFile(filepath.Join(dir, "seen.txt"))
+	if err != nil {
+		t.Fatalf("read seen.txt: %v", err)
+	}
+	lines := strings.Split(string(seen), "\n")
+	if lines[0] != "--config "+filepath.Join(configDir, "vite.config.ts")+" build" || lines[1] != filepath.Join(configDir, "tool.conf") {
+		t.Fatalf("unexpected command line or env: %q", lines[:2])
+	}
+	listing := strings.Join(lines[2:], " ")
+	if strings.Contains(listing, "vite.config.ts") || strings.Contains(listing, "tool.conf") || !strings.Contains(listing, "other.txt") {
+		t.Fatalf("expected only other.txt to be staged, got: %s", listing)
+	}
+}
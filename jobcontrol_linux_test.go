@@ -0,0 +1,173 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func openPty(t *testing.T) (*os.File, *os.File) {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("pseudo-terminals not available: %v", err)
+	}
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		_ = master.Close()
+		t.Skipf("cannot unlock pty: %v", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		_ = master.Close()
+		t.Skipf("cannot get pty number: %v", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		_ = master.Close()
+		t.Skipf("cannot open pty slave: %v", err)
+	}
+	return master, slave
+}
+
+// TestHelperJobShell plays the part of an interactive shell: it runs confik as
+// a foreground job on its controlling terminal, expects the job to stop, then
+// brings it back with `fg`.
+func TestHelperJobShell(t *testing.T) {
+	if os.Getenv("CONFIK_JOBSHELL") != "1" {
+		return
+	}
+	args := []string{}
+	for i, arg := range os.Args {
+		if arg == "--" {
+			args = os.Args[i+1:]
+			break
+		}
+	}
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=TestHelperProcess", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), "CONFIK_HELPER=1", "CONFIK_JOBSHELL=")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Foreground: true, Ctty: 0}
+	if err := cmd.Start(); err != nil {
+		os.Exit(20)
+	}
+	pid := cmd.Process.Pid
+
+	var status unix.WaitStatus
+	if _, err := unix.Wait4(pid, &status, unix.WUNTRACED, nil); err != nil || !status.Stopped() {
+		os.Exit(10)
+	}
+	if foreground, err := unix.IoctlGetInt(0, unix.TIOCGPGRP); err != nil || foreground != pid {
+		os.Exit(11)
+	}
+
+	// fg: hand the terminal to the job and continue it.
+	signal.Ignore(syscall.SIGTTOU)
+	_ = unix.IoctlSetPointerInt(0, unix.TIOCSPGRP, pid)
+	signal.Reset(syscall.SIGTTOU)
+	_ = syscall.Kill(-pid, syscall.SIGCONT)
+
+	if _, err := unix.Wait4(pid, &status, unix.WUNTRACED, nil); err != nil || !status.Exited() {
+		os.Exit(12)
+	}
+	os.Exit(status.ExitStatus())
+}
+
+// runJobShell runs confik with args as a foreground job on a fresh terminal
+// and waits for the job shell to finish.
+func runJobShell(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	master, slave := openPty(t)
+	defer func() { _ = master.Close() }()
+
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=TestHelperJobShell", "--"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CONFIK_JOBSHELL=1")
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start shell: %v", err)
+	}
+	_ = slave.Close()
+
+	var output bytes.Buffer
+	go func() { _, _ = io.Copy(&output, master) }()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("job shell failed: %v (output: %s)", err, output.String())
+		}
+	case <-time.After(15 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatalf("job did not finish (output: %s)", output.String())
+	}
+}
+
+func TestJobControlStopAndResume(t *testing.T) {
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	// Fields 5 and 8 of stat are the process group and the terminal's
+	// foreground process group.
+	script := `cut -d' ' -f5,8 /proc/self/stat > before.txt
+kill -TSTP $$
+cut -d' ' -f5,8 /proc/self/stat > after.txt
+test -f example.txt`
+	runJobShell(t, dir, "sh", "-c", script)
+
+	for _, name := range []string{"before.txt", "after.txt"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] != fields[1] {
+			t.Fatalf("expected command to own the terminal in %s, got %q", name, data)
+		}
+	}
+	if exists(filepath.Join(dir, "example.txt")) {
+		t.Fatalf("expected staged file to be cleaned up")
+	}
+}
+
+func TestJobControlStopAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".config"), 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+
+	// The first run fails; the restarted one stops itself and must be
+	// resumed by fg like the first would have been.
+	script := `if test -f first.done; then kill -TSTP $$; touch resumed.txt; exit 0; fi
+touch first.done
+exit 1`
+	runJobShell(t, dir, "--restart", "on-failure", "--max-restarts", "1", "--", "sh", "-c", script)
+
+	if !exists(filepath.Join(dir, "resumed.txt")) {
+		t.Fatalf("expected the restarted command to be resumed")
+	}
+}
@@ -0,0 +1,106 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// jobControl makes confik a transparent wrapper in an interactive shell. The
+// command runs in its own process group that owns the terminal, and when it
+// is stopped (Ctrl+Z) confik takes the terminal back and stops too, so the
+// shell sees one job. On fg/bg confik resumes and passes the SIGCONT on.
+type jobControl struct {
+	tty    int
+	pgid   int
+	child  int
+	contCh chan os.Signal
+}
+
+// newJobControl returns nil unless stdin is a terminal whose foreground
+// process group is confik's own, i.e. confik was started as a foreground job.
+func newJobControl() *jobControl {
+	tty := int(os.Stdin.Fd())
+	foreground, err := unix.IoctlGetInt(tty, unix.TIOCGPGRP)
+	if err != nil || foreground != syscall.Getpgrp() {
+		return nil
+	}
+	return &jobControl{tty: tty, pgid: syscall.Getpgrp(), contCh: make(chan os.Signal, 1)}
+}
+
+func (j *jobControl) prepare(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.SysProcAttr.Foreground = true
+	cmd.SysProcAttr.Ctty = j.tty
+}
+
+// wait waits for the command to exit, following it through stops and
+// continues, and returns its exit code. SIGCONT is watched for the length of
+// each call, since a restarted command is waited on with the same jobControl.
+func (j *jobControl) wait(cmd *exec.Cmd) (int, error) {
+	pid := cmd.Process.Pid
+	j.child = pid
+	signal.Notify(j.contCh, syscall.SIGCONT)
+	defer j.restore()
+	for {
+		var status unix.WaitStatus
+		_, err := unix.Wait4(pid, &status, unix.WUNTRACED, nil)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return 1, err
+		}
+		if status.Stopped() {
+			j.suspend(status.StopSignal())
+			continue
+		}
+		// The command was reaped here rather than by cmd.Wait.
+		_ = cmd.Process.Release()
+		return exitCode(syscall.WaitStatus(status)), nil
+	}
+}
+
+// suspend stops confik with the signal that stopped the command and, once
+// continued, resumes the command in the foreground or background to match.
+func (j *jobControl) suspend(stopSignal syscall.Signal) {
+	j.setForeground(j.child, j.pgid)
+	for len(j.contCh) > 0 {
+		<-j.contCh
+	}
+	_ = syscall.Kill(os.Getpid(), stopSignal)
+	<-j.contCh
+
+	j.setForeground(j.pgid, j.child)
+	_ = syscall.Kill(-j.child, syscall.SIGCONT)
+}
+
+// restore takes the terminal back from the command's process group after it
+// exits so confik's cleanup output does not land in a dead foreground group.
+func (j *jobControl) restore() {
+	j.setForeground(j.child, j.pgid)
+	signal.Stop(j.contCh)
+}
+
+// setForeground moves the terminal from one process group to another, but only
+// if from currently owns it: after `bg` confik must not grab the terminal.
+func (j *jobControl) setForeground(from, to int) {
+	if current, err := unix.IoctlGetInt(j.tty, unix.TIOCGPGRP); err != nil || current != from {
+		return
+	}
+	// tcsetpgrp from a background process group raises SIGTTOU unless it is
+	// ignored. It is ignored only for the call: the disposition would otherwise
+	// be inherited by commands started later.
+	signal.Ignore(syscall.SIGTTOU)
+	_ = unix.IoctlSetPointerInt(j.tty, unix.TIOCSPGRP, to)
+	signal.Reset(syscall.SIGTTOU)
+}
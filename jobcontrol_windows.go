@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import "os/exec"
+
+// jobControl has no equivalent on Windows consoles.
+type jobControl struct{}
+
+func newJobControl() *jobControl {
+	return nil
+}
+
+func (j *jobControl) prepare(cmd *exec.Cmd) {}
+
+func (j *jobControl) wait(cmd *exec.Cmd) (int, error) {
+	err := cmd.Wait()
+	return cmd.ProcessState.ExitCode(), err
+}
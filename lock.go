@@ -1,62 +1,335 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	lockPollInterval = 100 * time.Millisecond
+	// staleLockGrace gives a new holder time to write its metadata before a
+	// dead recorded pid is treated as a stale lock.
+	staleLockGrace = 2 * time.Second
+)
+
+// Lock backends. flock uses advisory OS locks; exclusive uses an O_EXCL
+// lockfile with a heartbeat for filesystems where OS locks are unreliable
+// (NFS, overlay, FUSE). auto uses flock and falls back when it is unsupported.
+const (
+	lockBackendAuto      = "auto"
+	lockBackendFlock     = "flock"
+	lockBackendExclusive = "exclusive"
+	envLockBackend       = "CONFIK_LOCK_BACKEND"
+)
+
+// lockBackend is a mutual-exclusion primitive bound to one lock path.
+type lockBackend interface {
+	// tryLock takes the lock without blocking and reports whether it succeeded.
+	tryLock() (bool, error)
+	unlock() error
+	writeMetadata(meta LockMetadata) error
+	readMetadata() (LockMetadata, error)
+	// staleReason reports why a holder can no longer own the lock, or "".
+	staleReason(holder LockMetadata) string
+	// discard removes the lock so the next tryLock starts fresh.
+	discard() error
+}
+
 type FileLock struct {
-	file *os.File
+	backend lockBackend
 }
 
-func acquireLock(lockPath string) (*FileLock, error) {
-	// #nosec G304 -- lockPath is derived from cwd/.config/lockFilename.
-	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0o600)
-	if err != nil {
-		return nil, err
+// LockOptions controls how long acquireLock waits for another holder and
+// which backend it uses. A zero Timeout waits indefinitely.
+type LockOptions struct {
+	Timeout   time.Duration
+	NoWait    bool
+	BreakLock bool
+	Backend   string
+}
+
+// LockMetadata is the holder information written into the lock file.
+type LockMetadata struct {
+	PID       int
+	StartID   string
+	Host      string
+	Command   string
+	CreatedAt string
+}
+
+func acquireLock(lockPath string, opts LockOptions) (*FileLock, error) {
+	backend := newLockBackend(lockPath, opts.Backend)
+	if opts.BreakLock {
+		if err := breakLock(backend, lockPath); err != nil {
+			return nil, err
+		}
 	}
 
-	locked, err := tryLockFile(file)
+	locked, err := backend.tryLock()
+	if err != nil && (opts.Backend == "" || opts.Backend == lockBackendAuto) && isLockUnsupported(err) {
+		fmt.Fprintf(os.Stderr, "confik: file locking is not supported here (%v), using lockfile backend\n", err)
+		_ = backend.unlock()
+		backend = newLockBackend(lockPath, lockBackendExclusive)
+		locked, err = backend.tryLock()
+	}
 	if err != nil {
-		_ = file.Close()
+		_ = backend.unlock()
 		return nil, err
 	}
 	if !locked {
-		fmt.Fprintln(os.Stderr, "confik: another instance is running, waiting for lock...")
-		if err := lockFile(file); err != nil {
-			_ = file.Close()
+		if err := waitForLock(backend, lockPath, opts); err != nil {
+			_ = backend.unlock()
 			return nil, err
 		}
 	}
 
-	_ = writeLockMetadata(file)
+	_ = backend.writeMetadata(currentLockMetadata())
+
+	return &FileLock{backend: backend}, nil
+}
+
+func newLockBackend(lockPath, name string) lockBackend {
+	if name == lockBackendExclusive {
+		return &exclusiveLockBackend{path: exclusiveLockPath(lockPath)}
+	}
+	return &flockBackend{path: lockPath}
+}
+
+// resolveLockBackend picks the backend from the environment, then confik.json.
+func resolveLockBackend(configured string) (string, error) {
+	name := os.Getenv(envLockBackend)
+	if name == "" {
+		name = configured
+	}
+	switch name {
+	case "":
+		return lockBackendAuto, nil
+	case lockBackendAuto, lockBackendFlock, lockBackendExclusive:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown lock backend %q (expected auto, flock or exclusive)", name)
+}
+
+func waitForLock(backend lockBackend, lockPath string, opts LockOptions) error {
+	holder, _ := backend.readMetadata()
+	if opts.NoWait {
+		return fmt.Errorf("lock %s is held by %s (use --lock-timeout to wait)", lockPath, describeLockHolder(holder))
+	}
+
+	fmt.Fprintf(os.Stderr, "confik: another instance is running, waiting for lock held by %s...\n", describeLockHolder(holder))
+
+	start := time.Now()
+	staleSince := time.Time{}
+	for {
+		time.Sleep(lockPollInterval)
+		locked, err := backend.tryLock()
+		if err != nil {
+			return err
+		}
+		if locked {
+			return nil
+		}
+
+		current, _ := backend.readMetadata()
+		if current != holder {
+			holder = current
+			staleSince = time.Time{}
+			fmt.Fprintf(os.Stderr, "confik: lock now held by %s, still waiting...\n", describeLockHolder(holder))
+		}
+		if reason := backend.staleReason(holder); reason != "" {
+			if staleSince.IsZero() {
+				staleSince = time.Now()
+			} else if time.Since(staleSince) >= staleLockGrace {
+				return fmt.Errorf("lock %s is still held, but its recorded holder %s %s; another process may have inherited it. Re-run with --break-lock to discard the lock", lockPath, describeLockHolder(holder), reason)
+			}
+		} else {
+			staleSince = time.Time{}
+		}
+
+		if opts.Timeout > 0 && time.Since(start) >= opts.Timeout {
+			return fmt.Errorf("timed out after %s waiting for lock held by %s", opts.Timeout, describeLockHolder(holder))
+		}
+	}
+}
+
+// breakLock removes a lock whose recorded holder is gone. A fresh lock is
+// created on the next attempt, so a process still holding the old one no
+// longer excludes anyone.
+func breakLock(backend lockBackend, lockPath string) error {
+	holder, err := backend.readMetadata()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if backend.staleReason(holder) == "" {
+		return fmt.Errorf("refusing to break lock %s: holder %s is still running", lockPath, describeLockHolder(holder))
+	}
+	fmt.Fprintf(os.Stderr, "confik: breaking stale lock held by %s\n", describeLockHolder(holder))
+	return backend.discard()
+}
 
-	return &FileLock{file: file}, nil
+// lockHolderStaleReason explains why the recorded holder can no longer own the
+// lock, or returns "" when it appears to be running. Holders on other hosts
+// cannot be checked and are assumed to be alive.
+func lockHolderStaleReason(holder LockMetadata) string {
+	if holder.PID <= 0 {
+		return ""
+	}
+	if holder.Host != "" && holder.Host != lockHostname() {
+		return ""
+	}
+	if !processAlive(holder.PID) {
+		return "is no longer running"
+	}
+	if !processRunning(holder.PID, holder.StartID) {
+		return "was reused by a different process"
+	}
+	return ""
+}
+
+func describeLockHolder(holder LockMetadata) string {
+	if holder.PID <= 0 {
+		return "an unknown process"
+	}
+	desc := fmt.Sprintf("pid %d", holder.PID)
+	if holder.Host != "" && holder.Host != lockHostname() {
+		desc += " on " + holder.Host
+	}
+	if holder.Command != "" {
+		desc += fmt.Sprintf(" (%s)", holder.Command)
+	}
+	if holder.CreatedAt != "" {
+		desc += " since " + holder.CreatedAt
+	}
+	return desc
 }
 
 func (l *FileLock) Unlock() error {
-	if l == nil || l.file == nil {
+	if l == nil || l.backend == nil {
 		return nil
 	}
-	err := unlockFile(l.file)
-	_ = l.file.Close()
-	l.file = nil
+	err := l.backend.unlock()
+	l.backend = nil
 	return err
 }
 
-func writeLockMetadata(file *os.File) error {
+func currentLockMetadata() LockMetadata {
+	pid := os.Getpid()
+	return LockMetadata{
+		PID:       pid,
+		StartID:   processStartID(pid),
+		Host:      lockHostname(),
+		Command:   strings.Join(os.Args, " "),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+func lockHostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func formatLockMetadata(meta LockMetadata) string {
+	return fmt.Sprintf("pid=%d\nstart_id=%s\nhost=%s\ncommand=%s\ncreated_at=%s\n", meta.PID, meta.StartID, meta.Host, meta.Command, meta.CreatedAt)
+}
+
+func writeLockMetadata(file *os.File, meta LockMetadata) error {
 	if err := file.Truncate(0); err != nil {
 		return err
 	}
 	if _, err := file.Seek(0, 0); err != nil {
 		return err
 	}
-	pid := os.Getpid()
-	stamp := time.Now().UTC().Format(time.RFC3339)
-	_, err := fmt.Fprintf(file, "pid=%d\ncreated_at=%s\n", pid, stamp)
-	if err != nil {
+	if _, err := file.WriteString(formatLockMetadata(meta)); err != nil {
 		return err
 	}
 	return file.Sync()
 }
+
+func readLockMetadata(lockPath string) (LockMetadata, error) {
+	// #nosec G304 -- lockPath is derived from cwd/.config/lockFilename.
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		return LockMetadata{}, err
+	}
+	meta := LockMetadata{}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "pid":
+			meta.PID, _ = strconv.Atoi(value)
+		case "start_id":
+			meta.StartID = value
+		case "host":
+			meta.Host = value
+		case "command":
+			meta.Command = value
+		case "created_at":
+			meta.CreatedAt = value
+		}
+	}
+	return meta, nil
+}
+
+// flockBackend locks the lock file itself with flock (LockFileEx on Windows).
+// The kernel releases the lock when the holder exits.
+type flockBackend struct {
+	path string
+	file *os.File
+}
+
+func (b *flockBackend) tryLock() (bool, error) {
+	if b.file == nil {
+		// #nosec G304 -- path is derived from cwd/.config/lockFilename.
+		file, err := os.OpenFile(b.path, os.O_CREATE|os.O_RDWR, 0o600)
+		if err != nil {
+			return false, err
+		}
+		b.file = file
+	}
+	return tryLockFile(b.file)
+}
+
+func (b *flockBackend) unlock() error {
+	if b.file == nil {
+		return nil
+	}
+	err := unlockFile(b.file)
+	_ = b.file.Close()
+	b.file = nil
+	return err
+}
+
+func (b *flockBackend) writeMetadata(meta LockMetadata) error {
+	if b.file == nil {
+		return errors.New("lock not held")
+	}
+	return writeLockMetadata(b.file, meta)
+}
+
+func (b *flockBackend) readMetadata() (LockMetadata, error) {
+	return readLockMetadata(b.path)
+}
+
+func (b *flockBackend) staleReason(holder LockMetadata) string {
+	return lockHolderStaleReason(holder)
+}
+
+func (b *flockBackend) discard() error {
+	if err := os.Remove(b.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// lockHeartbeatInterval is how often a holder refreshes the lockfile mtime.
+	lockHeartbeatInterval = 5 * time.Second
+	// lockHeartbeatTimeout is how old a heartbeat may get before the holder is
+	// considered dead. It is the only signal available for holders on other hosts.
+	lockHeartbeatTimeout = 30 * time.Second
+)
+
+func exclusiveLockPath(lockPath string) string {
+	return lockPath + ".excl"
+}
+
+// exclusiveLockBackend holds the lock by creating its lockfile with O_EXCL,
+// which is atomic even on NFS. The holder keeps the mtime fresh so waiters can
+// tell a live holder from one that crashed without removing the file.
+type exclusiveLockBackend struct {
+	path string
+	file *os.File
+	stop chan struct{}
+}
+
+func (b *exclusiveLockBackend) tryLock() (bool, error) {
+	if b.file != nil {
+		return true, nil
+	}
+	// #nosec G304 -- path is derived from cwd/.config/lockFilename.
+	file, err := os.OpenFile(b.path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0o600)
+	if err != nil {
+		if !errors.Is(err, os.ErrExist) {
+			return false, err
+		}
+		aside, ok := b.takeOverStale()
+		if !ok {
+			return false, nil
+		}
+		// #nosec G304 -- path is derived from cwd/.config/lockFilename.
+		file, err = os.OpenFile(b.path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0o600)
+		// The stale file is removed only now, so that the new lockfile cannot
+		// reuse its inode and pass for it in another waiter's check.
+		_ = os.Remove(aside)
+		if err != nil {
+			if errors.Is(err, os.ErrExist) {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	b.file = file
+	b.stop = make(chan struct{})
+	go b.heartbeat(b.stop)
+	return true, nil
+}
+
+// takeOverStale moves the lockfile aside when its holder is provably gone and
+// returns where it was moved. Several waiters may judge the same file stale,
+// so the takeover is a rename, which only one of them can win for a given
+// file. A waiter that finds it moved a different file (a lockfile another
+// waiter created after its own takeover) puts that file back and keeps
+// waiting.
+func (b *exclusiveLockBackend) takeOverStale() (string, bool) {
+	inspected, err := os.Stat(b.path)
+	if err != nil {
+		return "", false
+	}
+	holder, err := b.readMetadata()
+	if err != nil {
+		return "", false
+	}
+	reason := b.staleReason(holder)
+	if reason == "" {
+		return "", false
+	}
+	aside, ok := b.moveAside(inspected)
+	if !ok {
+		return "", false
+	}
+	fmt.Fprintf(os.Stderr, "confik: removing stale lockfile held by %s (holder %s)\n", describeLockHolder(holder), reason)
+	return aside, true
+}
+
+// moveAside renames the lockfile to a unique name and reports whether it was
+// the inspected file, compared by device and inode. Otherwise the file is
+// put back: a link fails rather than replace a lockfile created since.
+func (b *exclusiveLockBackend) moveAside(inspected os.FileInfo) (string, bool) {
+	aside := fmt.Sprintf("%s.stale-%d-%d", b.path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(b.path, aside); err != nil {
+		return "", false
+	}
+	moved, err := os.Stat(aside)
+	if err == nil && os.SameFile(inspected, moved) {
+		return aside, true
+	}
+	if err := os.Link(aside, b.path); err == nil || errors.Is(err, os.ErrExist) {
+		_ = os.Remove(aside)
+	} else {
+		_ = os.Rename(aside, b.path)
+	}
+	return "", false
+}
+
+func (b *exclusiveLockBackend) heartbeat(stop chan struct{}) {
+	ticker := time.NewTicker(lockHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			_ = os.Chtimes(b.path, now, now)
+		}
+	}
+}
+
+func (b *exclusiveLockBackend) unlock() error {
+	if b.file == nil {
+		return nil
+	}
+	close(b.stop)
+	_ = b.file.Close()
+	b.file = nil
+	if err := os.Remove(b.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (b *exclusiveLockBackend) writeMetadata(meta LockMetadata) error {
+	if b.file == nil {
+		return errors.New("lock not held")
+	}
+	return writeLockMetadata(b.file, meta)
+}
+
+func (b *exclusiveLockBackend) readMetadata() (LockMetadata, error) {
+	return readLockMetadata(b.path)
+}
+
+func (b *exclusiveLockBackend) staleReason(holder LockMetadata) string {
+	if reason := lockHolderStaleReason(holder); reason != "" {
+		return reason
+	}
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return ""
+	}
+	if age := time.Since(info.ModTime()); age > lockHeartbeatTimeout {
+		return fmt.Sprintf("has not refreshed its heartbeat for %s", age.Round(time.Second))
+	}
+	return ""
+}
+
+func (b *exclusiveLockBackend) discard() error {
+	if err := os.Remove(b.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
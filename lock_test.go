@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var testLockBackends = []string{lockBackendFlock, lockBackendExclusive}
+
+func TestLockMetadataRoundTrip(t *testing.T) {
+	for _, backend := range testLockBackends {
+		t.Run(backend, func(t *testing.T) {
+			lockPath := filepath.Join(t.TempDir(), lockFilename)
+			lock, err := acquireLock(lockPath, LockOptions{Backend: backend})
+			if err != nil {
+				t.Fatalf("acquireLock error: %v", err)
+			}
+			defer func() { _ = lock.Unlock() }()
+
+			meta, err := lock.backend.readMetadata()
+			if err != nil {
+				t.Fatalf("readMetadata error: %v", err)
+			}
+			if meta.PID != os.Getpid() || meta.Host == "" || meta.Command == "" || meta.CreatedAt == "" {
+				t.Fatalf("unexpected metadata: %#v", meta)
+			}
+			if lock.backend.staleReason(meta) != "" {
+				t.Fatalf("expected own process to be a live holder")
+			}
+		})
+	}
+}
+
+func TestAcquireLockContention(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lock metadata is not readable while locked on windows")
+	}
+
+	for _, backend := range testLockBackends {
+		t.Run(backend, func(t *testing.T) {
+			lockPath := filepath.Join(t.TempDir(), lockFilename)
+			holder, err := acquireLock(lockPath, LockOptions{Backend: backend})
+			if err != nil {
+				t.Fatalf("acquireLock error: %v", err)
+			}
+			defer func() { _ = holder.Unlock() }()
+
+			_, err = acquireLock(lockPath, LockOptions{Backend: backend, NoWait: true})
+			if err == nil {
+				t.Fatalf("expected --no-wait to fail while the lock is held")
+			}
+			if !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+				t.Fatalf("expected holder pid in error, got %v", err)
+			}
+
+			start := time.Now()
+			_, err = acquireLock(lockPath, LockOptions{Backend: backend, Timeout: 300 * time.Millisecond})
+			if err == nil || !strings.Contains(err.Error(), "timed out") {
+				t.Fatalf("expected timeout error, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Fatalf("timeout took too long: %v", elapsed)
+			}
+
+			released := make(chan struct{})
+			go func() {
+				defer close(released)
+				time.Sleep(200 * time.Millisecond)
+				_ = holder.Unlock()
+			}()
+			lock, err := acquireLock(lockPath, LockOptions{Backend: backend, Timeout: 5 * time.Second})
+			// The deferred Unlock must not run alongside the goroutine's.
+			<-released
+			if err != nil {
+				t.Fatalf("expected lock after release, got %v", err)
+			}
+			_ = lock.Unlock()
+		})
+	}
+}
+
+func TestStaleLockHolder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lock metadata is not readable while locked on windows")
+	}
+
+	lockPath := filepath.Join(t.TempDir(), lockFilename)
+	holder, err := acquireLock(lockPath, LockOptions{Backend: lockBackendFlock})
+	if err != nil {
+		t.Fatalf("acquireLock error: %v", err)
+	}
+	defer func() { _ = holder.Unlock() }()
+
+	dead := deadPID(t)
+	stale := fmt.Sprintf("pid=%d\ncommand=confik vite\ncreated_at=2024-01-01T00:00:00Z\n", dead)
+	if err := os.WriteFile(lockPath, []byte(stale), 0o600); err != nil {
+		t.Fatalf("write stale metadata: %v", err)
+	}
+
+	_, err = acquireLock(lockPath, LockOptions{Backend: lockBackendFlock, Timeout: 10 * time.Second})
+	if err == nil || !strings.Contains(err.Error(), "no longer running") || !strings.Contains(err.Error(), "--break-lock") {
+		t.Fatalf("expected stale holder error, got %v", err)
+	}
+
+	lock, err := acquireLock(lockPath, LockOptions{Backend: lockBackendFlock, BreakLock: true, NoWait: true})
+	if err != nil {
+		t.Fatalf("expected --break-lock to recover, got %v", err)
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	if err := breakLock(lock.backend, lockPath); err == nil {
+		t.Fatalf("expected breakLock to refuse a live holder")
+	}
+}
+
+func TestExclusiveLockStaleTakeoverHasOneWinner(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), lockFilename)
+	stale := fmt.Sprintf("pid=%d\nhost=%s\ncreated_at=2024-01-01T00:00:00Z\n", deadPID(t), lockHostname())
+	if err := os.WriteFile(exclusiveLockPath(lockPath), []byte(stale), 0o600); err != nil {
+		t.Fatalf("write stale lockfile: %v", err)
+	}
+
+	const waiters = 8
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	held := 0
+	start := make(chan struct{})
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			backend := &exclusiveLockBackend{path: exclusiveLockPath(lockPath)}
+			<-start
+			ok, err := backend.tryLock()
+			if err != nil {
+				t.Errorf("tryLock: %v", err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				held++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if held != 1 {
+		t.Fatalf("expected exactly one waiter to take over the stale lock, got %d", held)
+	}
+}
+
+func TestExclusiveLockMoveAsidePutsBackAnotherLockfile(t *testing.T) {
+	lockPath := exclusiveLockPath(filepath.Join(t.TempDir(), lockFilename))
+	if err := os.WriteFile(lockPath, []byte("pid=1\n"), 0o600); err != nil {
+		t.Fatalf("write stale lockfile: %v", err)
+	}
+	inspected, err := os.Stat(lockPath)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	// Another waiter takes over first: the stale file is moved away and a
+	// fresh one created in its place.
+	if err := os.Rename(lockPath, lockPath+".taken"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	fresh := fmt.Sprintf("pid=%d\n", os.Getpid())
+	if err := os.WriteFile(lockPath, []byte(fresh), 0o600); err != nil {
+		t.Fatalf("write fresh lockfile: %v", err)
+	}
+
+	backend := &exclusiveLockBackend{path: lockPath}
+	if _, ok := backend.moveAside(inspected); ok {
+		t.Fatalf("expected the takeover of a different lockfile to fail")
+	}
+	data, err := os.ReadFile(lockPath)
+	if err != nil || string(data) != fresh {
+		t.Fatalf("expected the fresh lockfile to be put back, got %q (%v)", data, err)
+	}
+	matches, _ := filepath.Glob(lockPath + ".stale-*")
+	if len(matches) != 0 {
+		t.Fatalf("expected no file left aside, got %v", matches)
+	}
+}
+
+func TestExclusiveLockTakesOverStaleHolder(t *testing.T) {
+	t.Run("dead-pid", func(t *testing.T) {
+		lockPath := filepath.Join(t.TempDir(), lockFilename)
+		stale := fmt.Sprintf("pid=%d\nhost=%s\ncreated_at=2024-01-01T00:00:00Z\n", deadPID(t), lockHostname())
+		if err := os.WriteFile(exclusiveLockPath(lockPath), []byte(stale), 0o600); err != nil {
+			t.Fatalf("write stale lockfile: %v", err)
+		}
+
+		lock, err := acquireLock(lockPath, LockOptions{Backend: lockBackendExclusive, NoWait: true})
+		if err != nil {
+			t.Fatalf("expected stale lockfile to be taken over, got %v", err)
+		}
+		if err := lock.Unlock(); err != nil {
+			t.Fatalf("unlock error: %v", err)
+		}
+		if exists(exclusiveLockPath(lockPath)) {
+			t.Fatalf("expected lockfile to be removed on unlock")
+		}
+	})
+
+	t.Run("expired-heartbeat-on-other-host", func(t *testing.T) {
+		lockPath := filepath.Join(t.TempDir(), lockFilename)
+		excl := exclusiveLockPath(lockPath)
+		remote := fmt.Sprintf("pid=%d\nhost=other-%s\ncreated_at=2024-01-01T00:00:00Z\n", os.Getpid(), lockHostname())
+		if err := os.WriteFile(excl, []byte(remote), 0o600); err != nil {
+			t.Fatalf("write remote lockfile: %v", err)
+		}
+
+		if _, err := acquireLock(lockPath, LockOptions{Backend: lockBackendExclusive, NoWait: true}); err == nil {
+			t.Fatalf("expected remote holder with a fresh heartbeat to keep the lock")
+		}
+
+		old := time.Now().Add(-2 * lockHeartbeatTimeout)
+		if err := os.Chtimes(excl, old, old); err != nil {
+			t.Fatalf("age lockfile: %v", err)
+		}
+		lock, err := acquireLock(lockPath, LockOptions{Backend: lockBackendExclusive, NoWait: true})
+		if err != nil {
+			t.Fatalf("expected expired heartbeat to be taken over, got %v", err)
+		}
+		_ = lock.Unlock()
+	})
+}
+
+func TestResolveLockBackend(t *testing.T) {
+	t.Setenv(envLockBackend, "")
+	if got, err := resolveLockBackend(""); err != nil || got != lockBackendAuto {
+		t.Fatalf("expected auto default, got %q, %v", got, err)
+	}
+	if got, err := resolveLockBackend(lockBackendExclusive); err != nil || got != lockBackendExclusive {
+		t.Fatalf("expected configured backend, got %q, %v", got, err)
+	}
+	t.Setenv(envLockBackend, lockBackendFlock)
+	if got, err := resolveLockBackend(lockBackendExclusive); err != nil || got != lockBackendFlock {
+		t.Fatalf("expected environment to override config, got %q, %v", got, err)
+	}
+	t.Setenv(envLockBackend, "nfs")
+	if _, err := resolveLockBackend(""); err == nil {
+		t.Fatalf("expected error for unknown backend")
+	}
+}
+
+func TestIsLockUnsupported(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("flock errnos are unix-specific")
+	}
+	if !isLockUnsupported(&os.PathError{Op: "flock", Err: syscall.ENOLCK}) {
+		t.Fatalf("expected ENOLCK to trigger the fallback")
+	}
+	if isLockUnsupported(syscall.EACCES) {
+		t.Fatalf("did not expect EACCES to trigger the fallback")
+	}
+}
+
+func TestProcessRunningDetectsPidReuse(t *testing.T) {
+	pid := os.Getpid()
+	startID := processStartID(pid)
+	if !processRunning(pid, startID) {
+		t.Fatalf("expected current process to be running")
+	}
+	if startID == "" {
+		t.Skip("process start IDs are not available on this platform")
+	}
+	if processRunning(pid, startID+"0") {
+		t.Fatalf("expected mismatched start ID to be treated as a different process")
+	}
+	if processRunning(deadPID(t), "") {
+		t.Fatalf("expected dead pid to be reported as not running")
+	}
+}
+
+func TestStagingWithExclusiveLockBackend(t *testing.T) {
+	t.Setenv(envLockBackend, lockBackendExclusive)
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	code, _, stderr := runConfik(t, dir, testCommandArgs(0)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if exists(filepath.Join(dir, "example.txt")) || exists(filepath.Join(dir, lockFilename+".excl")) {
+		t.Fatalf("expected staging and lock artifacts to be cleaned up")
+	}
+	if exists(exclusiveLockPath(filepath.Join(configDir, lockFilename))) {
+		t.Fatalf("expected lockfile to be released")
+	}
+}
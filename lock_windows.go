@@ -21,12 +21,13 @@ func tryLockFile(file *os.File) (bool, error) {
 	return false, err
 }
 
-func lockFile(file *os.File) error {
-	var ol windows.Overlapped
-	return windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &ol)
-}
-
 func unlockFile(file *os.File) error {
 	var ol windows.Overlapped
 	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, &ol)
 }
+
+// isLockUnsupported reports whether LockFileEx failed because the filesystem
+// does not support byte-range locks (typical for some network redirectors).
+func isLockUnsupported(err error) bool {
+	return errors.Is(err, windows.ERROR_NOT_SUPPORTED) || errors.Is(err, windows.ERROR_INVALID_FUNCTION)
+}
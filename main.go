@@ -4,13 +4,15 @@ import (
 	"crypto/rand"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/fs"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -34,20 +36,72 @@ type CLIFlags struct {
 	Gitignore bool
 	Registry  bool
 	Help      bool
+	FromRef   string
+	Lock      LockOptions
+	WaitTree  bool
+	Init      bool
+	Timeout   time.Duration
+	Restart   RestartPolicy
+	// Watch re-syncs the staging when .config changes; WatchRestart also
+	// restarts the command.
+	Watch        bool
+	WatchRestart bool
+	Parallel     ParallelOptions
+	// Shell runs the command line through $SHELL -c.
+	Shell bool
+	// EnvFile receives the staging details also exported to the command.
+	EnvFile string
+	// All ignores the per-command rules in confik.json.
+	All bool
+	// Profile selects a profile from confik.json.
+	Profile string
+	// Only replaces the include patterns from confik.json.
+	Only []string
+	// Except adds to the exclude patterns from confik.json.
+	Except []string
+}
+
+// optionsWithValue lists options that take an argument, either as the next
+// argument or inline as --option=value.
+var optionsWithValue = map[string]bool{
+	"--from-ref":     true,
+	"--lock-timeout": true,
+	"--timeout":      true,
+	"--restart":      true,
+	"--max-restarts": true,
+	"--success":      true,
+	"--profile":      true,
+	"--only":         true,
+	"--except":       true,
+	"--env-file":     true,
 }
 
 type ParsedArgs struct {
 	Flags       CLIFlags
 	Command     string
 	CommandArgs []string
+	// Script is the package.json script run by `confik run`.
+	Script string
+	// Separated is set when the command followed "--".
+	Separated bool
 }
 
 type ConfigFile struct {
-	Exclude          []string `json:"exclude"`
-	Registry         *bool    `json:"registry"`
-	RegistryOverride []string `json:"registryOverride"`
-	Gitignore        *bool    `json:"gitignore"`
-	VSCodeExclude    *bool    `json:"vscodeExclude"`
+	Include          []string               `json:"include"`
+	Exclude          []string               `json:"exclude"`
+	Registry         *bool                  `json:"registry"`
+	RegistryOverride []string               `json:"registryOverride"`
+	Gitignore        *bool                  `json:"gitignore"`
+	VSCodeExclude    *bool                  `json:"vscodeExclude"`
+	LockBackend      string                 `json:"lockBackend"`
+	StateLocation    string                 `json:"state"`
+	WaitTree         *bool                  `json:"waitTree"`
+	Timeout          string                 `json:"timeout"`
+	Inject           []InjectRule           `json:"inject"`
+	InjectRegistry   *bool                  `json:"injectRegistry"`
+	Commands         map[string]CommandRule `json:"commands"`
+	RespectGitignore *bool                  `json:"respectGitignore"`
+	Profiles         map[string]Profile     `json:"profiles"`
 }
 
 type ConfikConfig struct {
@@ -56,11 +110,27 @@ type ConfikConfig struct {
 	RegistryOverride []string
 	Gitignore        bool
 	VSCodeExclude    bool
-	Path             string
+	LockBackend      string
+	StateLocation    string
+	WaitTree         bool
+	Timeout          time.Duration
+	Inject           []InjectRule
+	InjectRegistry   bool
+	Commands         map[string]CommandRule
+	RespectGitignore bool
+	Profiles         map[string]Profile
+	// Include, when set, limits staging to matching files.
+	Include []string
+	// Ignore holds the lines of .config/.confikignore.
+	Ignore []string
+	// Profile is the name of the applied profile, if any.
+	Profile string
+	Path    string
 }
 
 type RegistryPayload struct {
-	Patterns []string `json:"patterns"`
+	Patterns []string     `json:"patterns"`
+	Inject   []InjectRule `json:"inject"`
 }
 
 func main() {
@@ -76,6 +146,19 @@ func run() error {
 		return err
 	}
 
+	if isSubcommand(os.Args[1:]) {
+		switch os.Args[1] {
+		case "hooks":
+			return runHooksCommand(cwd, os.Args[2:])
+		case "ps":
+			return runPsCommand(os.Args[2:])
+		case "gc":
+			return runGcCommand(os.Args[2:])
+		case watchdogCommand:
+			return runWatchdog(os.Args[2:])
+		}
+	}
+
 	parsed, err := parseArgs(os.Args[1:])
 	if err != nil {
 		return err
@@ -85,6 +168,10 @@ func run() error {
 		printHelp()
 		return nil
 	}
+	parsed, err = resolvePackageScript(cwd, parsed)
+	if err != nil {
+		return err
+	}
 
 	configDir := filepath.Join(cwd, ".config")
 	if !isDirectory(configDir) {
@@ -95,14 +182,67 @@ func run() error {
 		if parsed.Command == "" {
 			return nil
 		}
-		return runCommandAndExit(parsed.Command, parsed.CommandArgs, func() error { return nil })
+		return runParsedCommand(parsed, commandOptions{Env: nodeBinEnv(cwd, nil), Init: parsed.Flags.Init, Jobs: jobControlFor(parsed), Timeout: parsed.Flags.Timeout, Restart: parsed.Flags.Restart}, func() error { return nil })
+	}
+
+	overrides := configOverrides{profile: resolveProfileName(parsed.Flags.Profile), only: parsed.Flags.Only, except: parsed.Flags.Except}
+	workingConfig, err := overrides.apply(loadConfig(configDir))
+	if err != nil {
+		return err
+	}
+	if workingConfig.WaitTree && !parsed.Flags.Parallel.Enabled {
+		// Parallel commands cannot share one tree, so --parallel ignores the
+		// config default, as parseArgs rejects --wait-tree.
+		parsed.Flags.WaitTree = true
+	}
+	if parsed.Flags.Timeout == 0 {
+		parsed.Flags.Timeout = workingConfig.Timeout
+	}
+	stateLocation, err := resolveStateLocation(workingConfig.StateLocation)
+	if err != nil {
+		return err
+	}
+	state, err := resolveStatePaths(cwd, stateLocation)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(state.Dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create state directory %s (%v)", state.Dir, err)
+	}
+	lockPath := state.LockPath
+	manifestPath := state.ManifestPath
+	if enclosingRunID, ok := detectEnclosingRun(configDir, manifestPath); ok {
+		return runNested(cwd, parsed, enclosingRunID)
 	}
 
-	lockPath := filepath.Join(configDir, lockFilename)
-	lock, err := acquireLock(lockPath)
+	lockOpts := parsed.Flags.Lock
+	lockOpts.Backend, err = resolveLockBackend(workingConfig.LockBackend)
 	if err != nil {
 		return err
 	}
+	selection := commandSelection(parsed)
+	stager := &stagingSync{
+		cwd:          cwd,
+		configDir:    configDir,
+		lockPath:     lockPath,
+		manifestPath: manifestPath,
+		backend:      lockOpts.Backend,
+		gitignore:    parsed.Flags.Gitignore,
+		registry:     parsed.Flags.Registry,
+		overrides:    overrides,
+		command:      selection,
+	}
+	var watch *stagingSync
+	if parsed.Flags.Watch {
+		watch = stager
+	}
+	lock, err := acquireLock(lockPath, lockOpts)
+	if err != nil {
+		return err
+	}
+	if err := migrateLegacyState(configDir, state); err != nil {
+		fmt.Fprintf(os.Stderr, "confik: state migration incomplete (%v)\n", err)
+	}
 	lockHeld := true
 	unlock := func() error {
 		if lockHeld {
@@ -115,73 +255,142 @@ func run() error {
 
 	if parsed.Flags.Clean {
 		defer func() { _ = unlock() }()
-		return cleanLeftovers(cwd, true, false)
+		if manifest, err := readManifest(manifestPath); err == nil {
+			if live := liveParticipants(manifest.Participants); len(live) > 0 {
+				return fmt.Errorf("run %s is still active (%s); stop it before cleaning", manifest.RunID, describeParticipants(live))
+			}
+		}
+		return cleanLeftovers(cwd, manifestPath, true, false)
 	}
 
-	if exists(filepath.Join(configDir, manifestFilename)) {
-		if err := cleanLeftovers(cwd, false, true); err != nil {
+	if exists(manifestPath) {
+		if parsed.Flags.DryRun {
+			if manifest, err := readManifest(manifestPath); err == nil && len(liveParticipants(manifest.Participants)) > 0 {
+				if err := checkSessionSource(manifest, parsed.Flags.FromRef); err != nil {
+					return combineErrors(err, unlock())
+				}
+				_, _ = fmt.Fprintf(os.Stdout, "confik: dry-run: would attach to active run %s (%d file(s) staged)\n", manifest.RunID, len(manifest.CreatedFiles))
+				return unlock()
+			}
+		} else {
+			self := newParticipant(parsed.Command, parsed.CommandArgs)
+			manifest, err := attachSession(manifestPath, self, parsed.Flags.FromRef)
+			if err != nil {
+				return combineErrors(err, unlock())
+			}
+			if manifest != nil {
+				// The staging was done for another command. Point this one at
+				// its config in .config and stage whatever else it needs.
+				var injectEnv []string
+				if parsed.Flags.FromRef == "" {
+					var injections []injection
+					entries := listWorkingTreeEntries(configDir)
+					filter := newStageFilter(workingConfig, false).withGitIgnored(cwd, workingConfig, entries).forCommand(workingConfig, selection)
+					parsed, injectEnv, injections = injectForCommand(cwd, parsed, workingConfig, parsed.Flags.Registry && workingConfig.Registry, entries, filter)
+					stager.injected = injectedFiles(injections)
+					result, err := stager.apply(manifest, true)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "confik: staging for %s incomplete (%v)\n", parsed.Command, err)
+					}
+					if result.added > 0 {
+						_, _ = fmt.Fprintf(os.Stdout, "confik: staged %d more file(s) for this command\n", result.added)
+					}
+				}
+				if err := unlock(); err != nil {
+					return err
+				}
+				_, _ = fmt.Fprintf(os.Stdout, "confik: attached to active run %s (%d file(s) staged)\n", manifest.RunID, len(manifest.CreatedFiles))
+				record := newSessionRecord(cwd, state, lockOpts.Backend, manifest.RunID, self)
+				env := &runEnv{runID: manifest.RunID, cwd: cwd, configDir: configDir, manifestPath: manifestPath, envFile: parsed.Flags.EnvFile, extra: injectEnv}
+				return superviseRun(parsed, env, watch, withSessionRecord(record, sessionDetacher(cwd, lockPath, manifestPath, lockOpts.Backend, self.PID)))
+			}
+		}
+		if err := cleanLeftovers(cwd, manifestPath, false, true); err != nil {
 			fmt.Fprintf(os.Stderr, "confik: pre-run cleanup incomplete (%v)\n", err)
 		}
 	}
 
-	config := loadConfig(configDir)
+	var entries []configEntry
+	var config ConfikConfig
+	sourceCommit := ""
+	if parsed.Flags.FromRef != "" {
+		commit, err := resolveRevision(cwd, parsed.Flags.FromRef)
+		if err != nil {
+			return combineErrors(err, unlock())
+		}
+		entries, err = listRevisionEntries(cwd, commit)
+		if err != nil {
+			return combineErrors(err, unlock())
+		}
+		sourceCommit = commit
+		config = defaultConfig(filepath.Join(configDir, configFilename))
+		if data, ok := readRevisionFile(cwd, commit, configFilename); ok {
+			config = parseConfig(config, data)
+		}
+		if data, ok := readRevisionFile(cwd, commit, ignoreFilename); ok {
+			config.Ignore = parseIgnoreFile(data)
+		}
+		config, err = overrides.apply(config)
+		if err != nil {
+			return combineErrors(err, unlock())
+		}
+	} else {
+		entries = listWorkingTreeEntries(configDir)
+		config = workingConfig
+	}
 
 	useGitignore := parsed.Flags.Gitignore && config.Gitignore
 	useRegistry := parsed.Flags.Registry && config.Registry
 
-	registryPatterns := []string{}
-	if useRegistry {
-		registryPatterns = loadRegistryPatterns()
+	filter := newStageFilter(config, useRegistry).forCommand(config, selection)
+	var injectEnv []string
+	if parsed.Flags.FromRef == "" {
+		filter = filter.withGitIgnored(cwd, config, entries)
+		var injections []injection
+		parsed, injectEnv, injections = injectForCommand(cwd, parsed, config, useRegistry, entries, filter)
+		filter.injected = injectedFiles(injections)
+		stager.injected = filter.injected
 	}
 
 	createdFiles := []string{}
 	createdDirs := []string{}
-	skippedExisting := []string{}
-	skippedExcluded := []string{}
-	skippedRegistry := []string{}
+	var skipped skipReport
 
 	var vscodeContext *VSCodeContext
 	var gitContext *GitContext
+	var hgContext *HgContext
 	runID := createRunID()
-	manifestPath := filepath.Join(configDir, manifestFilename)
+	self := newParticipant(parsed.Command, parsed.CommandArgs)
 	cleanupStaging := func() error {
-		return cleanupStagedArtifacts(manifestPath, createdFiles, createdDirs, vscodeContext, gitContext, unlock, true)
+		return cleanupStagedArtifacts(manifestPath, createdFiles, createdDirs, vscodeContext, gitContext, hgContext, unlock, true)
 	}
 
 	dirCache := map[string]bool{}
-	walkErr := filepath.WalkDir(configDir, func(pathname string, d fs.DirEntry, entryErr error) error {
-		if entryErr != nil {
+	stageEntry := func(entry configEntry) error {
+		relPosix := entry.Rel
+		switch filter.classify(relPosix) {
+		case entryInternal:
 			return nil
-		}
-		if d.IsDir() {
+		case entryExcluded:
+			skipped.excluded = append(skipped.excluded, relPosix)
 			return nil
-		}
-
-		rel, err := filepath.Rel(configDir, pathname)
-		if err != nil {
+		case entryGitIgnored:
+			skipped.gitIgnored = append(skipped.gitIgnored, relPosix)
 			return nil
-		}
-
-		relPosix := filepath.ToSlash(rel)
-		if relPosix == configFilename || relPosix == manifestFilename || relPosix == lockFilename {
+		case entryUnselected:
+			skipped.unselected = append(skipped.unselected, relPosix)
 			return nil
-		}
-
-		if matchesPatternList(relPosix, config.Exclude, true) {
-			skippedExcluded = append(skippedExcluded, relPosix)
+		case entryInjected:
+			skipped.injected = append(skipped.injected, relPosix)
+			return nil
+		case entryRegistry:
+			skipped.registry = append(skipped.registry, relPosix)
 			return nil
 		}
 
-		if useRegistry && matchesPatternList(relPosix, registryPatterns, true) {
-			if !matchesPatternList(relPosix, config.RegistryOverride, true) {
-				skippedRegistry = append(skippedRegistry, relPosix)
-				return nil
-			}
-		}
-
-		dest := filepath.Join(cwd, rel)
+		dest := filepath.Join(cwd, filepath.FromSlash(relPosix))
 		if exists(dest) {
-			skippedExisting = append(skippedExisting, relPosix)
+			skipped.existing = append(skipped.existing, relPosix)
 			return nil
 		}
 
@@ -190,18 +399,24 @@ func run() error {
 			return err
 		}
 		if !ok {
-			skippedExisting = append(skippedExisting, relPosix)
+			skipped.existing = append(skipped.existing, relPosix)
 			return nil
 		}
 
 		if !parsed.Flags.DryRun {
-			if err := copyFile(pathname, dest); err != nil {
+			if err := copyEntry(cwd, entry, dest); err != nil {
 				return err
 			}
 		}
 		createdFiles = append(createdFiles, dest)
 		return nil
-	})
+	}
+	var walkErr error
+	for _, entry := range entries {
+		if walkErr = stageEntry(entry); walkErr != nil {
+			break
+		}
+	}
 	if walkErr != nil {
 		return combineErrors(walkErr, cleanupStaging())
 	}
@@ -217,38 +432,7 @@ func run() error {
 	}
 
 	if !parsed.Flags.DryRun && useGitignore && len(createdFiles) > 0 {
-		gitRoot := findGitRoot(cwd)
-		if gitRoot != "" {
-			gitDir, err := resolveGitDir(gitRoot)
-			if err == nil {
-				relPaths := []string{}
-				for _, filePath := range createdFiles {
-					rel, err := filepath.Rel(gitRoot, filePath)
-					if err != nil {
-						continue
-					}
-					if strings.HasPrefix(rel, "..") {
-						continue
-					}
-					posixRel := filepath.ToSlash(rel)
-					if !strings.HasPrefix(posixRel, "/") {
-						posixRel = "/" + posixRel
-					}
-					relPaths = append(relPaths, posixRel)
-				}
-				if len(relPaths) > 0 {
-					excludePath, err := appendGitIgnoreBlock(gitDir, runID, relPaths)
-					if err == nil {
-						gitContext = &GitContext{
-							GitRoot:     gitRoot,
-							GitDir:      gitDir,
-							ExcludePath: excludePath,
-							RunID:       runID,
-						}
-					}
-				}
-			}
-		}
+		gitContext, hgContext = applyVCSIgnore(cwd, runID, createdFiles)
 	}
 
 	manifest := Manifest{
@@ -256,17 +440,30 @@ func run() error {
 		CreatedFiles: toRelativeList(cwd, createdFiles),
 		CreatedDirs:  toRelativeList(cwd, createdDirs),
 		Gitignore:    gitContext,
+		Mercurial:    hgContext,
 		VSCode:       vscodeContext,
+		SourceRef:    parsed.Flags.FromRef,
+		SourceCommit: sourceCommit,
 		CreatedAt:    time.Now().UTC().Format(time.RFC3339),
+		Participants: []Participant{self},
 	}
 
-	if !parsed.Flags.DryRun && len(createdFiles) > 0 {
+	// With --watch the manifest is needed even when nothing is staged yet, so
+	// that files added later have a run to belong to.
+	if !parsed.Flags.DryRun && (len(createdFiles) > 0 || parsed.Flags.Watch) {
 		if err := writeManifest(manifestPath, manifest); err != nil {
 			return combineErrors(err, cleanupStaging())
 		}
 	}
 
-	printSummary(parsed.Flags.DryRun, createdFiles, skippedExisting, skippedExcluded, skippedRegistry)
+	printSummary(parsed.Flags.DryRun, createdFiles, skipped, selection, config.Profile)
+	if len(skipped.injected) > 0 {
+		verb := "running"
+		if parsed.Flags.DryRun {
+			verb = "would run"
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "confik: %s: %s\n", verb, describeCommandLine(injectEnv, parsed.Command, parsed.CommandArgs))
+	}
 
 	if parsed.Flags.DryRun {
 		if err := unlock(); err != nil {
@@ -280,11 +477,60 @@ func run() error {
 		return nil
 	}
 
+	// Other processes may attach to this staging from here on; whoever detaches
+	// last cleans up.
+	if err := unlock(); err != nil {
+		return combineErrors(err, cleanupStaging())
+	}
+
+	record := newSessionRecord(cwd, state, lockOpts.Backend, runID, self)
+	env := &runEnv{runID: runID, cwd: cwd, configDir: configDir, manifestPath: manifestPath, envFile: parsed.Flags.EnvFile, extra: injectEnv}
+	return superviseRun(parsed, env, watch, withSessionRecord(record, sessionDetacher(cwd, lockPath, manifestPath, lockOpts.Backend, self.PID)))
+}
+
+// sessionDetacher returns a cleanup function that detaches pid from the shared
+// staging and removes it if no other live participant remains.
+func sessionDetacher(cwd, lockPath, manifestPath, backend string, pid int) func() error {
+	return func() error {
+		lock, err := acquireLock(lockPath, LockOptions{Backend: backend})
+		if err != nil {
+			return err
+		}
+		manifest, err := detachSession(manifestPath, pid)
+		if err != nil || manifest == nil {
+			return combineErrors(err, lock.Unlock())
+		}
+		return cleanupManifestArtifacts(cwd, manifestPath, manifest, lock.Unlock)
+	}
+}
+
+// superviseRun runs the command (or waits in standalone mode) and calls
+// cleanup exactly once, including when interrupted by a signal. If watch is
+// set, the staging follows changes to .config until cleanup.
+func superviseRun(parsed ParsedArgs, env *runEnv, watch *stagingSync, cleanupFn func() error) error {
+	writeEnvFile := func() {
+		if err := env.writeFile(); err != nil {
+			fmt.Fprintf(os.Stderr, "confik: failed to write env file (%v)\n", err)
+		}
+	}
+	writeEnvFile()
+
+	group := &processGroup{}
+	stopWatch := func() {}
+	if watch != nil {
+		var bounce *processGroup
+		if parsed.Flags.WatchRestart && parsed.Command != "" {
+			bounce = group
+		}
+		stopWatch = watch.watch(bounce, writeEnvFile)
+	}
+
 	cleanupOnce := sync.Once{}
 	var cleanupErr error
 	cleanup := func() error {
 		cleanupOnce.Do(func() {
-			cleanupErr = cleanupStaging()
+			stopWatch()
+			cleanupErr = combineErrors(cleanupFn(), env.removeFile())
 		})
 		return cleanupErr
 	}
@@ -306,31 +552,123 @@ func run() error {
 		return fmt.Errorf("interrupted")
 	}
 
-	go func() {
-		sig := <-sigCh
-		// Restore default signal handling before cleanup so a second Ctrl+C force-exits.
-		signal.Stop(sigCh)
-		fmt.Fprintf(os.Stderr, "confik: received %s, cleaning up...\n", sig.String())
-		if err := cleanup(); err != nil {
-			fmt.Fprintf(os.Stderr, "confik: cleanup incomplete (%v)\n", err)
+	jobs := jobControlFor(parsed)
+	var tree *processTree
+	if parsed.Flags.WaitTree {
+		var err error
+		if tree, err = newProcessTree(treeGracePeriod); err != nil {
+			fmt.Fprintf(os.Stderr, "confik: %v; not waiting for background processes\n", err)
 		}
-		os.Exit(1)
-	}()
+	}
 
-	return runCommandAndExit(parsed.Command, parsed.CommandArgs, cleanup)
+	switch {
+	case parsed.Flags.Parallel.Enabled:
+		// runParallel forwards signals to every command and cleanup runs once
+		// they have all exited.
+	case parsed.Flags.Init:
+		// runAsInit forwards signals to the command itself and cleanup runs
+		// once the command exits; sigCh just stays registered until then.
+	case tree != nil:
+		// The command has its own process group, so terminal signals reach only
+		// confik. Forward them and let the normal exit path wait for the tree.
+		go func() {
+			for sig := range sigCh {
+				fmt.Fprintf(os.Stderr, "confik: received %s, forwarding to command...\n", sig.String())
+				group.stop(sig)
+			}
+		}()
+	default:
+		go func() {
+			sig := <-sigCh
+			// Restore default signal handling before cleanup so a second Ctrl+C force-exits.
+			signal.Stop(sigCh)
+			fmt.Fprintf(os.Stderr, "confik: received %s, cleaning up...\n", sig.String())
+			if group.hasOwnGroup() {
+				group.stop(sig)
+			} else {
+				group.requestStop()
+			}
+			if err := cleanup(); err != nil {
+				fmt.Fprintf(os.Stderr, "confik: cleanup incomplete (%v)\n", err)
+			}
+			os.Exit(1)
+		}()
+	}
+
+	return runParsedCommand(parsed, commandOptions{Env: nodeBinEnv(env.cwd, env.vars), Tree: tree, Init: parsed.Flags.Init, Jobs: jobs, Timeout: parsed.Flags.Timeout, Group: group, Restart: parsed.Flags.Restart, Isolate: parsed.Flags.WatchRestart}, cleanup)
+}
+
+// jobControlFor returns job control when confik runs as a foreground job in an
+// interactive shell. An init process has no shell to cooperate with, and
+// parallel commands cannot all own the terminal.
+func jobControlFor(parsed ParsedArgs) *jobControl {
+	if parsed.Flags.Init || parsed.Flags.Parallel.Enabled {
+		return nil
+	}
+	return newJobControl()
+}
+
+// runNested handles an invocation from inside a command wrapped by another
+// confik process for the same .config. Staging is already in place and owned
+// by the outer run, so the command runs as-is and nothing is cleaned up here.
+func runNested(cwd string, parsed ParsedArgs, enclosingRunID string) error {
+	if parsed.Flags.Clean {
+		return fmt.Errorf("cannot clean while enclosing run %s is active", enclosingRunID)
+	}
+	if parsed.Flags.DryRun || parsed.Command == "" {
+		_, _ = fmt.Fprintf(os.Stdout, "confik: .config already staged by enclosing run %s\n", enclosingRunID)
+		return nil
+	}
+	return runParsedCommand(parsed, commandOptions{Env: nodeBinEnv(cwd, nil), Init: parsed.Flags.Init, Jobs: jobControlFor(parsed), Timeout: parsed.Flags.Timeout, Restart: parsed.Flags.Restart}, func() error { return nil })
+}
+
+// isSubcommand reports whether args call one of confik's own commands. Other
+// arguments, such as `ps aux`, name a program to run, and `confik -- ps` always
+// does.
+func isSubcommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "hooks":
+		return len(args) == 2 && (args[1] == "install" || args[1] == "uninstall" || args[1] == "check")
+	case "ps":
+		return len(args) == 1
+	case "gc":
+		return len(args) == 1 || (len(args) == 2 && args[1] == "--dry-run")
+	case watchdogCommand:
+		return true
+	}
+	return false
 }
 
 func parseArgs(args []string) (ParsedArgs, error) {
 	flags := CLIFlags{DryRun: false, Clean: false, Gitignore: true, Registry: true, Help: false}
 	cmdIndex := -1
+	separated := false
 
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
 		if arg == "--" {
 			cmdIndex = i + 1
+			separated = true
 			break
 		}
-		switch arg {
+		name, inlineValue, hasInline := strings.Cut(arg, "=")
+		if !hasInline || !optionsWithValue[name] {
+			name, hasInline = arg, false
+		}
+		flagValue := func() (string, error) {
+			if hasInline {
+				return inlineValue, nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("option %s requires a value", name)
+			}
+			i++
+			return args[i], nil
+		}
+		switch name {
 		case "-h", "--help":
 			flags.Help = true
 		case "--dry-run":
@@ -341,6 +679,115 @@ func parseArgs(args []string) (ParsedArgs, error) {
 			flags.Gitignore = false
 		case "--no-registry":
 			flags.Registry = false
+		case "--from-ref":
+			value, err := flagValue()
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			if value == "" {
+				return ParsedArgs{}, fmt.Errorf("option %s requires a value", name)
+			}
+			flags.FromRef = value
+		case "--profile":
+			value, err := flagValue()
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			if value == "" {
+				return ParsedArgs{}, fmt.Errorf("option %s requires a value", name)
+			}
+			flags.Profile = value
+		case "--only", "--except":
+			value, err := flagValue()
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			if value == "" {
+				return ParsedArgs{}, fmt.Errorf("option %s requires a value", name)
+			}
+			if name == "--only" {
+				flags.Only = append(flags.Only, value)
+			} else {
+				flags.Except = append(flags.Except, value)
+			}
+		case "--env-file":
+			value, err := flagValue()
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			if value == "" {
+				return ParsedArgs{}, fmt.Errorf("option %s requires a value", name)
+			}
+			flags.EnvFile = value
+		case "--lock-timeout":
+			value, err := flagValue()
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return ParsedArgs{}, fmt.Errorf("invalid %s value: %q", name, value)
+			}
+			flags.Lock.Timeout = timeout
+		case "--timeout":
+			value, err := flagValue()
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return ParsedArgs{}, fmt.Errorf("invalid %s value: %q", name, value)
+			}
+			flags.Timeout = timeout
+		case "--restart":
+			value, err := flagValue()
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			if !validRestartMode(value) {
+				return ParsedArgs{}, fmt.Errorf("invalid %s value: %q (expected no, on-failure or always)", name, value)
+			}
+			flags.Restart.Mode = value
+		case "--max-restarts":
+			value, err := flagValue()
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				return ParsedArgs{}, fmt.Errorf("invalid %s value: %q", name, value)
+			}
+			flags.Restart.Max = limit
+		case "--no-wait":
+			flags.Lock.NoWait = true
+		case "--break-lock":
+			flags.Lock.BreakLock = true
+		case "--wait-tree":
+			flags.WaitTree = true
+		case "--init":
+			flags.Init = true
+		case "--watch":
+			flags.Watch = true
+		case "--watch-restart":
+			flags.Watch = true
+			flags.WatchRestart = true
+		case "-c", "--shell":
+			flags.Shell = true
+		case "--all":
+			flags.All = true
+		case "--parallel":
+			flags.Parallel.Enabled = true
+		case "--kill-others-on-fail":
+			flags.Parallel.KillOthersOnFail = true
+		case "--success":
+			value, err := flagValue()
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			if !validSuccessPolicy(value) {
+				return ParsedArgs{}, fmt.Errorf("invalid %s value: %q (expected all, first or last)", name, value)
+			}
+			flags.Parallel.Success = value
 		default:
 			if strings.HasPrefix(arg, "-") {
 				return ParsedArgs{}, fmt.Errorf("unknown option: %s", arg)
@@ -350,14 +797,44 @@ func parseArgs(args []string) (ParsedArgs, error) {
 		}
 	}
 
+	if flags.Restart.Max > 0 && (flags.Restart.Mode == "" || flags.Restart.Mode == restartNever) {
+		return ParsedArgs{}, fmt.Errorf("--max-restarts requires --restart on-failure or always")
+	}
+
+	if (flags.Parallel.KillOthersOnFail || flags.Parallel.Success != "") && !flags.Parallel.Enabled {
+		return ParsedArgs{}, fmt.Errorf("--kill-others-on-fail and --success require --parallel")
+	}
+	if flags.Parallel.Enabled {
+		switch {
+		case flags.Init:
+			return ParsedArgs{}, fmt.Errorf("--parallel cannot be combined with --init")
+		case flags.WaitTree:
+			return ParsedArgs{}, fmt.Errorf("--parallel cannot be combined with --wait-tree")
+		case flags.Restart.Mode != "" && flags.Restart.Mode != restartNever, flags.WatchRestart:
+			return ParsedArgs{}, fmt.Errorf("--parallel cannot be combined with restarts")
+		case cmdIndex < 0 || cmdIndex >= len(args):
+			return ParsedArgs{}, fmt.Errorf("--parallel requires at least one command")
+		}
+	}
+
+	if flags.Watch && flags.FromRef != "" {
+		return ParsedArgs{}, fmt.Errorf("--watch cannot be combined with --from-ref")
+	}
+
 	if cmdIndex < 0 || cmdIndex >= len(args) {
 		return ParsedArgs{Flags: flags}, nil
 	}
 
+	if flags.Shell && !flags.Parallel.Enabled {
+		command, commandArgs := shellCommand(strings.Join(args[cmdIndex:], " "))
+		return ParsedArgs{Flags: flags, Command: command, CommandArgs: commandArgs}, nil
+	}
+
 	return ParsedArgs{
 		Flags:       flags,
 		Command:     args[cmdIndex],
 		CommandArgs: args[cmdIndex+1:],
+		Separated:   separated,
 	}, nil
 }
 
@@ -368,22 +845,80 @@ Usage:
   confik [options]
   confik [options] -- <command> [args...]
   confik [options] <command> [args...]
+  confik [options] -c "<shell command>"
+  confik [options] run <script> [args...]
   confik --clean
+  confik hooks <install|uninstall|check>
+  confik ps
+  confik gc [--dry-run]
+
+Commands:
+  run <script>      Run a package.json script with its files staged
+  hooks install     Add a pre-commit guard that blocks commits of staged files
+  hooks uninstall   Remove the pre-commit guard
+  hooks check       Fail if the git index contains files staged by confik
+  ps                List active and orphaned sessions across all projects
+  gc                Clean up orphaned sessions left by crashed runs
+
+  Other arguments after hooks, ps or gc run a program of that name, and so
+  does anything after --, e.g. confik -- ps.
 
 Options:
-  --dry-run         Show what would be copied/ignored without writing files
-  --clean           Remove leftover staged files and confik gitignore blocks
-  --no-gitignore    Skip updating .git/info/exclude during the run
-  --no-registry     Ignore the built-in registry skip list
-  -h, --help        Show this help
+  --dry-run           Show what would be copied/ignored without writing files
+  --clean             Remove leftover staged files and confik ignore blocks
+  --no-gitignore      Skip temporary VCS ignore rules (.git/info/exclude, .hg)
+  --no-registry       Ignore the built-in registry skip list
+  --from-ref <rev>    Stage .config contents from a git commit or branch
+  --env-file <path>   Write the staging details exported to the command to a file
+  --lock-timeout <d>  Give up waiting for the lock after a duration (e.g. 30s)
+  --no-wait           Fail immediately if another instance holds the lock
+  --break-lock        Discard a lock whose recorded holder is no longer running
+  --wait-tree         Wait for processes spawned by the command before cleanup (Linux)
+  --init              Run as a container init (PID 1): forward signals, reap zombies (Linux)
+  --timeout <d>       Stop the command after a duration and exit with code 124
+  --restart <policy>  Restart the command on exit: no, on-failure or always
+  --max-restarts <n>  Give up after n restarts (default: no limit)
+  --watch             Re-stage files when .config changes (Linux)
+  --watch-restart     Like --watch, and restart the command after each change
+  -c, --shell         Run the command line through $SHELL -c
+  --only <glob>       Stage only matching files, instead of include in confik.json (repeatable)
+  --except <glob>     Skip matching files, in addition to exclude in confik.json (repeatable)
+  --profile <name>    Apply a profile from confik.json (default: $CONFIK_PROFILE)
+  --all               Stage every file, ignoring the per-command rules in confik.json
+  --parallel          Run each argument as a separate shell command, all at once
+  --kill-others-on-fail  With --parallel, stop the other commands when one fails
+  --success <policy>  With --parallel, exit with: all (first failure), first or last
+  -h, --help          Show this help
 `
 
 	_, _ = fmt.Fprint(os.Stdout, msg)
 }
 
-func loadConfig(configDir string) ConfikConfig {
-	configPath := filepath.Join(configDir, configFilename)
-	config := ConfikConfig{
+// configOverrides are the changes to confik.json asked for on the command
+// line or in the environment.
+type configOverrides struct {
+	profile string
+	only    []string
+	except  []string
+}
+
+// apply applies the profile, then --only and --except.
+func (o configOverrides) apply(config ConfikConfig) (ConfikConfig, error) {
+	config, err := applyProfile(config, o.profile)
+	if err != nil {
+		return config, err
+	}
+	if len(o.only) > 0 {
+		config.Include = o.only
+	}
+	if len(o.except) > 0 {
+		config.Exclude = append(append([]string{}, config.Exclude...), o.except...)
+	}
+	return config, nil
+}
+
+func defaultConfig(configPath string) ConfikConfig {
+	return ConfikConfig{
 		Exclude:          []string{},
 		Registry:         true,
 		RegistryOverride: []string{},
@@ -391,6 +926,12 @@ func loadConfig(configDir string) ConfikConfig {
 		VSCodeExclude:    false,
 		Path:             configPath,
 	}
+}
+
+func loadConfig(configDir string) ConfikConfig {
+	configPath := filepath.Join(configDir, configFilename)
+	config := defaultConfig(configPath)
+	config.Ignore = loadIgnoreFile(configDir)
 
 	if !exists(configPath) {
 		return config
@@ -403,12 +944,33 @@ func loadConfig(configDir string) ConfikConfig {
 		return config
 	}
 
+	return parseConfig(config, data)
+}
+
+func loadIgnoreFile(configDir string) []string {
+	ignorePath := filepath.Join(configDir, ignoreFilename)
+	if !exists(ignorePath) {
+		return nil
+	}
+	// #nosec G304 -- ignorePath is derived from cwd/.config and not user-supplied absolute input.
+	data, err := os.ReadFile(ignorePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "confik: failed to read %s; ignoring it (%v)\n", ignorePath, err)
+		return nil
+	}
+	return parseIgnoreFile(data)
+}
+
+func parseConfig(config ConfikConfig, data []byte) ConfikConfig {
 	var parsed ConfigFile
 	if err := json.Unmarshal(data, &parsed); err != nil {
-		fmt.Fprintf(os.Stderr, "confik: failed to parse %s; using defaults (%v)\n", configPath, err)
+		fmt.Fprintf(os.Stderr, "confik: failed to parse %s; using defaults (%v)\n", config.Path, err)
 		return config
 	}
 
+	if parsed.Include != nil {
+		config.Include = parsed.Include
+	}
 	if parsed.Exclude != nil {
 		config.Exclude = parsed.Exclude
 	}
@@ -424,19 +986,177 @@ func loadConfig(configDir string) ConfikConfig {
 	if parsed.VSCodeExclude != nil {
 		config.VSCodeExclude = *parsed.VSCodeExclude
 	}
+	if parsed.LockBackend != "" {
+		config.LockBackend = parsed.LockBackend
+	}
+	if parsed.StateLocation != "" {
+		config.StateLocation = parsed.StateLocation
+	}
+	if parsed.WaitTree != nil {
+		config.WaitTree = *parsed.WaitTree
+	}
+	if parsed.Inject != nil {
+		config.Inject = parsed.Inject
+	}
+	if parsed.InjectRegistry != nil {
+		config.InjectRegistry = *parsed.InjectRegistry
+	}
+	if parsed.Commands != nil {
+		config.Commands = parsed.Commands
+	}
+	if parsed.RespectGitignore != nil {
+		config.RespectGitignore = *parsed.RespectGitignore
+	}
+	if parsed.Profiles != nil {
+		config.Profiles = parsed.Profiles
+	}
+	if parsed.Timeout != "" {
+		timeout, err := time.ParseDuration(parsed.Timeout)
+		if err != nil || timeout <= 0 {
+			fmt.Fprintf(os.Stderr, "confik: ignoring invalid timeout %q in %s\n", parsed.Timeout, config.Path)
+		} else {
+			config.Timeout = timeout
+		}
+	}
 
 	return config
 }
 
+const (
+	entryStage = iota
+	entryInternal
+	entryExcluded
+	entryGitIgnored
+	entryUnselected
+	entryInjected
+	entryRegistry
+)
+
+// stageFilter decides which files in .config/ are copied into the project
+// root.
+type stageFilter struct {
+	exclude  ignoreMatcher
+	registry []string
+	override ignoreMatcher
+	// include, when set, limits staging to matching files.
+	include []string
+	// gitIgnored holds files left out by the repository's ignore rules.
+	gitIgnored map[string]bool
+	// selected, when set, limits staging to the files a command needs.
+	selected []string
+	// injected holds files passed to the command instead of being staged.
+	injected map[string]bool
+}
+
+func newStageFilter(config ConfikConfig, useRegistry bool) stageFilter {
+	// .confikignore comes first, so exclude in confik.json and --except can
+	// add to it and re-include what it leaves out.
+	filter := stageFilter{
+		exclude:  compileIgnore(config.Ignore).with(config.Exclude),
+		include:  config.Include,
+		override: compileIgnore(config.RegistryOverride),
+	}
+	if useRegistry {
+		filter.registry = loadRegistryPatterns()
+	}
+	return filter
+}
+
+// classify returns entryStage for a file that should be staged, or the
+// reason it is skipped.
+func (f stageFilter) classify(relPosix string) int {
+	if relPosix == configFilename || relPosix == ignoreFilename || isStateFile(relPosix) {
+		return entryInternal
+	}
+	if f.include != nil && !matchesPatternList(relPosix, f.include, true) {
+		return entryExcluded
+	}
+	if f.exclude.matches(relPosix) {
+		return entryExcluded
+	}
+	if f.gitIgnored[relPosix] {
+		return entryGitIgnored
+	}
+	if f.selected != nil && !matchesPatternList(relPosix, f.selected, true) {
+		return entryUnselected
+	}
+	if f.injected[relPosix] {
+		return entryInjected
+	}
+	if matchesPatternList(relPosix, f.registry, true) && !f.override.matches(relPosix) {
+		return entryRegistry
+	}
+	return entryStage
+}
+
+// withGitIgnored asks git which entries it ignores when respectGitignore is
+// set. Entries from a revision are tracked, so they are never ignored.
+func (f stageFilter) withGitIgnored(cwd string, config ConfikConfig, entries []configEntry) stageFilter {
+	if !config.RespectGitignore {
+		return f
+	}
+	ignored, err := gitIgnoredEntries(cwd, entries)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "confik: %v; not applying .gitignore rules to .config\n", err)
+		return f
+	}
+	f.gitIgnored = ignored
+	return f
+}
+
+// CommandRule narrows staging for one command: only files matching Include
+// (when given) and not matching Exclude are staged for it.
+type CommandRule struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// commandSelection names the commands entry that applies to this run: the
+// package.json script for `confik run`, otherwise the program name. It is
+// empty with --all and for runs without a single command.
+func commandSelection(parsed ParsedArgs) string {
+	if parsed.Flags.All || parsed.Flags.Parallel.Enabled || parsed.Command == "" {
+		return ""
+	}
+	if parsed.Script != "" {
+		return parsed.Script
+	}
+	return commandName(parsed.Command)
+}
+
+// forCommand applies the commands entry for selection, if there is one.
+func (f stageFilter) forCommand(config ConfikConfig, selection string) stageFilter {
+	rule, ok := config.Commands[selection]
+	if selection == "" || !ok {
+		return f
+	}
+	f.exclude = f.exclude.with(rule.Exclude)
+	if len(rule.Include) > 0 {
+		f.selected = rule.Include
+	}
+	return f
+}
+
+// isStateFile reports whether relPosix is one of confik's own lock or
+// manifest files kept in .config/.
+func isStateFile(relPosix string) bool {
+	return relPosix == manifestFilename || relPosix == lockFilename || relPosix == exclusiveLockPath(lockFilename) ||
+		strings.HasPrefix(relPosix, exclusiveLockPath(lockFilename)+".stale-")
+}
+
 func loadRegistryPatterns() []string {
+	return loadRegistry().Patterns
+}
+
+func loadRegistry() RegistryPayload {
+	payload := RegistryPayload{Patterns: []string{}, Inject: []InjectRule{}}
 	if len(embeddedRegistry) == 0 {
-		return []string{}
+		return payload
 	}
-	var payload RegistryPayload
 	if err := json.Unmarshal(embeddedRegistry, &payload); err != nil {
-		return []string{}
+		return RegistryPayload{Patterns: []string{}, Inject: []InjectRule{}}
 	}
-	return payload.Patterns
+	return payload
 }
 
 func matchesPatternList(target string, patterns []string, matchBase bool) bool {
@@ -471,8 +1191,21 @@ func createRunID() string {
 	return fmt.Sprintf("%s-%d", now, time.Now().UnixNano())
 }
 
-func printSummary(dryRun bool, createdFiles, skippedExisting, skippedExcluded, skippedRegistry []string) {
+// skipReport lists the files in .config that were not staged, by reason.
+type skipReport struct {
+	existing   []string
+	excluded   []string
+	gitIgnored []string
+	unselected []string
+	injected   []string
+	registry   []string
+}
+
+func printSummary(dryRun bool, createdFiles []string, skipped skipReport, selection, profile string) {
 	lines := []string{}
+	if profile != "" {
+		lines = append(lines, fmt.Sprintf("confik: using profile %s", profile))
+	}
 	if len(createdFiles) > 0 {
 		verb := "staged"
 		if dryRun {
@@ -480,43 +1213,188 @@ func printSummary(dryRun bool, createdFiles, skippedExisting, skippedExcluded, s
 		}
 		lines = append(lines, fmt.Sprintf("confik: %s %d file(s)", verb, len(createdFiles)))
 	}
-	if len(skippedExisting) > 0 {
-		lines = append(lines, fmt.Sprintf("confik: skipped %d existing file(s)", len(skippedExisting)))
+	if len(skipped.existing) > 0 {
+		lines = append(lines, fmt.Sprintf("confik: skipped %d existing file(s)", len(skipped.existing)))
+	}
+	if len(skipped.excluded) > 0 {
+		lines = append(lines, fmt.Sprintf("confik: excluded %d file(s)", len(skipped.excluded)))
+	}
+	if len(skipped.gitIgnored) > 0 {
+		lines = append(lines, fmt.Sprintf("confik: skipped %d git-ignored file(s)", len(skipped.gitIgnored)))
 	}
-	if len(skippedExcluded) > 0 {
-		lines = append(lines, fmt.Sprintf("confik: excluded %d file(s)", len(skippedExcluded)))
+	if len(skipped.unselected) > 0 {
+		lines = append(lines, fmt.Sprintf("confik: skipped %d file(s) not used by %s", len(skipped.unselected), selection))
 	}
-	if len(skippedRegistry) > 0 {
-		lines = append(lines, fmt.Sprintf("confik: registry-skipped %d file(s)", len(skippedRegistry)))
+	if len(skipped.registry) > 0 {
+		lines = append(lines, fmt.Sprintf("confik: registry-skipped %d file(s)", len(skipped.registry)))
+	}
+	if len(skipped.injected) > 0 {
+		verb := "passed"
+		if dryRun {
+			verb = "would pass"
+		}
+		lines = append(lines, fmt.Sprintf("confik: %s %d file(s) to the command instead of staging", verb, len(skipped.injected)))
 	}
 	if len(lines) > 0 {
 		_, _ = fmt.Fprintln(os.Stdout, strings.Join(lines, "\n"))
 	}
 }
 
-func runCommand(command string, args []string) (int, error) {
+// commandOptions controls how the wrapped command is run.
+type commandOptions struct {
+	// Env, when set, returns variables appended to confik's own environment.
+	// It is called each time the command starts.
+	Env func() []string
+	// Tree, when set, waits for everything the command left running.
+	Tree *processTree
+	// Init runs the command the way an init process would: confik forwards
+	// signals to it and reaps every orphan reparented to it.
+	Init bool
+	// Jobs, when set, gives the command the terminal and mirrors its stops.
+	Jobs *jobControl
+	// Timeout stops the command once it has run this long.
+	Timeout time.Duration
+	// Group, when set, is pointed at the command once it starts so that
+	// signal handlers can reach it.
+	Group *processGroup
+	// Restart decides whether the command is started again after it exits.
+	Restart RestartPolicy
+	// Isolate runs the command in its own process group so that everything
+	// it started can be stopped together.
+	Isolate bool
+	// Stdout and Stderr, when set, replace confik's own output streams. Such a
+	// command does not read confik's stdin.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func runCommand(command string, args []string, opts commandOptions) (int, error) {
 	cmd := exec.Command(command, args...)
+	if opts.Env != nil {
+		cmd.Env = append(os.Environ(), opts.Env()...)
+		lookCommandPath(cmd, command)
+	}
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if opts.Stdout != nil || opts.Stderr != nil {
+		cmd.Stdin = nil
+		cmd.Stdout = opts.Stdout
+		cmd.Stderr = opts.Stderr
+		// Don't let a background process holding the output pipes keep the
+		// command from being reported as exited.
+		cmd.WaitDelay = time.Second
+	}
+	cmd.SysProcAttr = commandSysProcAttr()
+	tree := opts.Tree
+	if tree != nil {
+		tree.prepare(cmd)
+	}
+	if opts.Jobs != nil {
+		opts.Jobs.prepare(cmd)
+	}
+	if opts.Timeout > 0 || opts.Isolate {
+		// A timeout or restart stops everything the command started, not just
+		// the command.
+		isolateProcessGroup(cmd)
+	}
+	passShellLine(cmd)
+	group := opts.Group
+	if group == nil {
+		group = &processGroup{}
+	}
+
+	var initSignals chan os.Signal
+	if opts.Init {
+		initSignals = notifyInit()
+		defer signal.Stop(initSignals)
+	}
 
-	err := cmd.Run()
+	if err := startOwnChild(cmd); err != nil {
+		return 1, fmt.Errorf("failed to run %s (%v)", command, err)
+	}
+	pid := cmd.Process.Pid
+	group.set(pid, hasOwnProcessGroup(cmd))
+	if tree != nil {
+		tree.started(pid)
+	}
+	timeout := startCommandTimeout(command, opts.Timeout, group)
+
+	var code int
+	var err error
+	switch {
+	case opts.Init:
+		code, err = waitAsInit(cmd, group, initSignals)
+	case opts.Jobs != nil:
+		code, err = opts.Jobs.wait(cmd)
+	default:
+		code, err = waitCommand(cmd)
+	}
+	forgetOwnChild(pid)
+	group.exited(pid)
+	timedOut := timeout.stop()
+	if tree != nil {
+		tree.wait()
+	}
+	if err != nil {
+		return 1, fmt.Errorf("failed to run %s (%v)", command, err)
+	}
+	if timedOut {
+		return timeoutExitCode, nil
+	}
+	return code, nil
+}
+
+func waitCommand(cmd *exec.Cmd) (int, error) {
+	err := cmd.Wait()
 	if err == nil {
 		return 0, nil
 	}
 
+	if errors.Is(err, exec.ErrWaitDelay) && cmd.ProcessState != nil {
+		// The command exited; only a background process it left behind still
+		// holds its output.
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+			return exitCode(status), nil
+		}
+		return cmd.ProcessState.ExitCode(), nil
+	}
+
 	if exitErr, ok := err.(*exec.ExitError); ok {
 		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-			return status.ExitStatus(), nil
+			return exitCode(status), nil
 		}
 		return 1, nil
 	}
 
-	return 1, fmt.Errorf("failed to run %s (%v)", command, err)
+	return 1, err
+}
+
+// exitCode follows the shell convention of 128+n for a command killed by
+// signal n.
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// runParsedCommand runs the command line given to confik, or every command
+// at once with --parallel, then cleans up and exits with the resulting code.
+func runParsedCommand(parsed ParsedArgs, opts commandOptions, cleanup func() error) error {
+	if parsed.Flags.Parallel.Enabled {
+		lines := append([]string{parsed.Command}, parsed.CommandArgs...)
+		return exitAfterCleanup(runParallel(lines, parsed.Flags.Parallel, opts), nil, cleanup)
+	}
+	return runCommandAndExit(parsed.Command, parsed.CommandArgs, opts, cleanup)
+}
+
+func runCommandAndExit(command string, args []string, opts commandOptions, cleanup func() error) error {
+	code, err := runWithRestarts(command, args, opts)
+	return exitAfterCleanup(code, err, cleanup)
 }
 
-func runCommandAndExit(command string, args []string, cleanup func() error) error {
-	code, err := runCommand(command, args)
+func exitAfterCleanup(code int, err error, cleanup func() error) error {
 	cleanupErr := cleanup()
 	if cleanupErr != nil {
 		fmt.Fprintf(os.Stderr, "confik: cleanup incomplete (%v)\n", cleanupErr)
@@ -14,6 +14,27 @@ import (
 	"time"
 )
 
+func TestMain(m *testing.M) {
+	// Watchdogs re-execute the test binary as a helper process rather than confik itself.
+	testBinary := os.Args[0]
+	selfCommand = func(args ...string) (*exec.Cmd, error) {
+		cmd := exec.Command(testBinary, append([]string{"-test.run=TestHelperProcess", "--"}, args...)...)
+		cmd.Env = append(os.Environ(), "CONFIK_HELPER=1")
+		return cmd, nil
+	}
+	// Keep session records written by test runs out of the real per-user state directory.
+	if os.Getenv("CONFIK_HELPER") == "" {
+		stateHome, err := os.MkdirTemp("", "confik-state-")
+		if err == nil {
+			_ = os.Setenv("XDG_STATE_HOME", stateHome)
+			code := m.Run()
+			_ = os.RemoveAll(stateHome)
+			os.Exit(code)
+		}
+	}
+	os.Exit(m.Run())
+}
+
 func TestParseArgs(t *testing.T) {
 	t.Run("flags-and-command", func(t *testing.T) {
 		parsed, err := parseArgs([]string{"--dry-run", "--no-gitignore", "echo", "hi"})
@@ -105,6 +126,122 @@ func TestParseArgs(t *testing.T) {
 		}
 	})
 
+	t.Run("from-ref", func(t *testing.T) {
+		parsed, err := parseArgs([]string{"--from-ref", "main", "echo"})
+		if err != nil {
+			t.Fatalf("parseArgs error: %v", err)
+		}
+		if parsed.Flags.FromRef != "main" || parsed.Command != "echo" {
+			t.Fatalf("unexpected parse result: %#v", parsed)
+		}
+
+		parsed, err = parseArgs([]string{"--from-ref=v1.2.0"})
+		if err != nil {
+			t.Fatalf("parseArgs error: %v", err)
+		}
+		if parsed.Flags.FromRef != "v1.2.0" {
+			t.Fatalf("expected inline value, got %q", parsed.Flags.FromRef)
+		}
+
+		if _, err := parseArgs([]string{"--from-ref"}); err == nil {
+			t.Fatalf("expected error for missing value")
+		}
+		if _, err := parseArgs([]string{"--dry-run=yes"}); err == nil {
+			t.Fatalf("expected error for inline value on boolean option")
+		}
+	})
+
+	t.Run("lock-options", func(t *testing.T) {
+		parsed, err := parseArgs([]string{"--lock-timeout", "30s", "--no-wait", "--break-lock", "echo"})
+		if err != nil {
+			t.Fatalf("parseArgs error: %v", err)
+		}
+		if parsed.Flags.Lock.Timeout != 30*time.Second || !parsed.Flags.Lock.NoWait || !parsed.Flags.Lock.BreakLock {
+			t.Fatalf("unexpected lock options: %#v", parsed.Flags.Lock)
+		}
+		if _, err := parseArgs([]string{"--lock-timeout=soon"}); err == nil {
+			t.Fatalf("expected error for invalid duration")
+		}
+	})
+
+	t.Run("process-modes", func(t *testing.T) {
+		parsed, err := parseArgs([]string{"--wait-tree", "--init", "--timeout=5m", "next", "dev"})
+		if err != nil {
+			t.Fatalf("parseArgs error: %v", err)
+		}
+		if !parsed.Flags.WaitTree || !parsed.Flags.Init || parsed.Flags.Timeout != 5*time.Minute || parsed.Command != "next" {
+			t.Fatalf("unexpected parse result: %#v", parsed)
+		}
+		if _, err := parseArgs([]string{"--timeout", "0s", "next"}); err == nil {
+			t.Fatalf("expected error for zero timeout")
+		}
+		parsed, err = parseArgs([]string{"--restart", "on-failure", "--max-restarts=5", "node", "server.js"})
+		if err != nil {
+			t.Fatalf("parseArgs error: %v", err)
+		}
+		if parsed.Flags.Restart != (RestartPolicy{Mode: restartOnFailure, Max: 5}) {
+			t.Fatalf("unexpected restart policy: %#v", parsed.Flags.Restart)
+		}
+		if _, err := parseArgs([]string{"--restart", "sometimes", "node"}); err == nil {
+			t.Fatalf("expected error for unknown restart policy")
+		}
+		if _, err := parseArgs([]string{"--max-restarts", "3", "node"}); err == nil {
+			t.Fatalf("expected error for --max-restarts without --restart")
+		}
+		parsed, err = parseArgs([]string{"--watch-restart", "vite"})
+		if err != nil {
+			t.Fatalf("parseArgs error: %v", err)
+		}
+		if !parsed.Flags.Watch || !parsed.Flags.WatchRestart {
+			t.Fatalf("expected --watch-restart to imply --watch: %#v", parsed.Flags)
+		}
+		if _, err := parseArgs([]string{"--watch", "--from-ref", "main", "vite"}); err == nil {
+			t.Fatalf("expected error for --watch with --from-ref")
+		}
+		parsed, err = parseArgs([]string{"--parallel", "--kill-others-on-fail", "--success=last", "--", "vite", "tsc --watch"})
+		if err != nil {
+			t.Fatalf("parseArgs error: %v", err)
+		}
+		if parsed.Flags.Parallel != (ParallelOptions{Enabled: true, KillOthersOnFail: true, Success: successLast}) || parsed.Command != "vite" || len(parsed.CommandArgs) != 1 {
+			t.Fatalf("unexpected parallel parse result: %#v", parsed)
+		}
+		parsed, err = parseArgs([]string{"--env-file=.confik.env", "vitest"})
+		if err != nil || parsed.Flags.EnvFile != ".confik.env" {
+			t.Fatalf("unexpected env file parse result: %#v (%v)", parsed, err)
+		}
+		parsed, err = parseArgs([]string{"--all", "vitest"})
+		if err != nil || !parsed.Flags.All || commandSelection(parsed) != "" {
+			t.Fatalf("unexpected --all parse result: %#v (%v)", parsed, err)
+		}
+		parsed, err = parseArgs([]string{"--only", "*.json", "--only=*.ts", "--except", "tsconfig.build.json", "tsc"})
+		if err != nil || strings.Join(parsed.Flags.Only, ",") != "*.json,*.ts" || strings.Join(parsed.Flags.Except, ",") != "tsconfig.build.json" {
+			t.Fatalf("unexpected only/except parse result: %#v (%v)", parsed, err)
+		}
+		parsed, err = parseArgs([]string{"--profile=ci", "vitest"})
+		if err != nil || parsed.Flags.Profile != "ci" {
+			t.Fatalf("unexpected profile parse result: %#v (%v)", parsed, err)
+		}
+		t.Setenv("SHELL", "/bin/sh")
+		parsed, err = parseArgs([]string{"-c", "npm run lint &&", "npm test"})
+		if err != nil {
+			t.Fatalf("parseArgs error: %v", err)
+		}
+		if runtime.GOOS != "windows" && (parsed.Command != "/bin/sh" || strings.Join(parsed.CommandArgs, "|") != "-c|npm run lint && npm test") {
+			t.Fatalf("unexpected shell parse result: %#v", parsed)
+		}
+		for _, args := range [][]string{
+			{"--success", "first", "vite"},
+			{"--parallel", "--success", "most", "vite"},
+			{"--parallel", "--init", "vite"},
+			{"--parallel", "--restart", "always", "vite"},
+			{"--parallel"},
+		} {
+			if _, err := parseArgs(args); err == nil {
+				t.Fatalf("expected error for %v", args)
+			}
+		}
+	})
+
 	t.Run("double-dash-only", func(t *testing.T) {
 		parsed, err := parseArgs([]string{"--"})
 		if err != nil {
@@ -153,7 +290,7 @@ func TestLoadConfigDefaultsAndOverrides(t *testing.T) {
 		t.Fatalf("expected vscodeExclude default false")
 	}
 
-	cfg := `{"exclude":["**/*.local"],"gitignore":false,"vscodeExclude":true}`
+	cfg := `{"include":["*.json"],"exclude":["**/*.local"],"gitignore":false,"vscodeExclude":true,"timeout":"15m"}`
 	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(cfg), 0o644); err != nil {
 		t.Fatalf("write config: %v", err)
 	}
@@ -162,6 +299,9 @@ func TestLoadConfigDefaultsAndOverrides(t *testing.T) {
 	if len(loaded.Exclude) != 1 || loaded.Exclude[0] != "**/*.local" {
 		t.Fatalf("expected exclude to load")
 	}
+	if len(loaded.Include) != 1 || loaded.Include[0] != "*.json" {
+		t.Fatalf("expected include to load")
+	}
 	if loaded.Gitignore {
 		t.Fatalf("expected gitignore false")
 	}
@@ -171,6 +311,9 @@ func TestLoadConfigDefaultsAndOverrides(t *testing.T) {
 	if !loaded.VSCodeExclude {
 		t.Fatalf("expected vscodeExclude true")
 	}
+	if loaded.Timeout != 15*time.Minute {
+		t.Fatalf("expected timeout 15m, got %s", loaded.Timeout)
+	}
 }
 
 func TestLoadRegistryPatterns(t *testing.T) {
@@ -514,6 +657,108 @@ func TestRegistryOverrideForcesCopy(t *testing.T) {
 	}
 }
 
+func TestIncludeIsCheckedBeforeExcludeAndRegistry(t *testing.T) {
+	config := defaultConfig("")
+	config.Include = []string{"*.json"}
+	config.Exclude = []string{"secret.json"}
+	config.RegistryOverride = []string{"cspell.json"}
+	filter := newStageFilter(config, true)
+	cases := map[string]int{
+		"tsconfig.json":          entryStage,
+		"README.md":              entryExcluded,
+		"secret.json":            entryExcluded,
+		"cspell.json":            entryStage,
+		"cspell.project.json":    entryRegistry,
+		"nested/commitlintrc.js": entryExcluded,
+	}
+	for rel, want := range cases {
+		if got := filter.classify(rel); got != want {
+			t.Fatalf("classify(%q) = %d, want %d", rel, got, want)
+		}
+	}
+
+	overridden, err := configOverrides{only: []string{"cspell*.json"}, except: []string{"*.secret"}}.apply(config)
+	if err != nil {
+		t.Fatalf("apply overrides: %v", err)
+	}
+	filter = newStageFilter(overridden, true)
+	if filter.classify("tsconfig.json") != entryExcluded || filter.classify("cspell.json") != entryStage || filter.classify("cspell.project.json") != entryRegistry {
+		t.Fatalf("expected --only to replace include and keep the registry rules")
+	}
+	if filter.classify("secret.json") != entryExcluded || strings.Join(config.Exclude, ",") != "secret.json" {
+		t.Fatalf("expected --except to add to a copy of exclude")
+	}
+}
+
+func TestOnlyAndExceptFlags(t *testing.T) {
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	cfg := `{"include":["a.txt"],"registryOverride":["cspell.json"]}`
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	for _, file := range []string{"a.txt", "b.txt", "c.txt", "cspell.json"} {
+		if err := os.WriteFile(filepath.Join(configDir, file), []byte(file), 0o644); err != nil {
+			t.Fatalf("write %s: %v", file, err)
+		}
+	}
+
+	code, stdout, stderr := runConfik(t, dir, append([]string{"--dry-run"}, testCommandArgs(0)...)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "would stage 1 file") || !strings.Contains(stdout, "excluded 3 file") {
+		t.Fatalf("expected include to stage only a.txt, got: %s", stdout)
+	}
+
+	code, stdout, stderr = runConfik(t, dir, append([]string{"--dry-run", "--only", "*.txt", "--only", "cspell.json", "--except", "c.txt"}, testCommandArgs(0)...)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "would stage 3 file") || !strings.Contains(stdout, "excluded 1 file") || strings.Contains(stdout, "registry-skipped") {
+		t.Fatalf("expected a.txt, b.txt and the overridden cspell.json to be staged, got: %s", stdout)
+	}
+}
+
+func TestRespectGitignoreSkipsIgnoredFiles(t *testing.T) {
+	dir := t.TempDir()
+	initGitRepo(t, dir)
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte(".config/*.local\n!.config/shared.local\n"), 0o644); err != nil {
+		t.Fatalf("write .gitignore: %v", err)
+	}
+	for _, file := range []string{"keep.txt", "env.local", "shared.local"} {
+		if err := os.WriteFile(filepath.Join(configDir, file), []byte(file), 0o644); err != nil {
+			t.Fatalf("write %s: %v", file, err)
+		}
+	}
+
+	code, stdout, stderr := runConfik(t, dir, append([]string{"--dry-run"}, testCommandArgs(0)...)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "would stage 3 file") || strings.Contains(stdout, "git-ignored") {
+		t.Fatalf("expected ignore rules to apply only when asked, got: %s", stdout)
+	}
+
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(`{"respectGitignore":true}`), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	code, stdout, stderr = runConfik(t, dir, testCommandArgs(0)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "staged 2 file") || !strings.Contains(stdout, "skipped 1 git-ignored file(s)") {
+		t.Fatalf("expected env.local to be skipped as git-ignored, got: %s", stdout)
+	}
+}
+
 func TestRegistryDisabledStagesAll(t *testing.T) {
 	dir := t.TempDir()
 	configDir := filepath.Join(dir, ".config")
@@ -737,6 +982,74 @@ func TestExcludePatternSkipsFiles(t *testing.T) {
 	}
 }
 
+func TestStageFilterForCommand(t *testing.T) {
+	config := defaultConfig("")
+	config.Exclude = []string{"*.secret"}
+	config.Commands = map[string]CommandRule{
+		"vitest": {Include: []string{"vitest.config.ts", "tsconfig*.json"}},
+		"lint":   {Exclude: []string{"vite.config.ts"}},
+	}
+	base := newStageFilter(config, false)
+
+	vitest := base.forCommand(config, "vitest")
+	cases := map[string]int{
+		"vitest.config.ts":   entryStage,
+		"tsconfig.base.json": entryStage,
+		"vite.config.ts":     entryUnselected,
+		"key.secret":         entryExcluded,
+	}
+	for rel, want := range cases {
+		if got := vitest.classify(rel); got != want {
+			t.Fatalf("vitest classify(%q) = %d, want %d", rel, got, want)
+		}
+	}
+
+	lint := base.forCommand(config, "lint")
+	if lint.classify("vite.config.ts") != entryExcluded || lint.classify("eslint.config.js") != entryStage {
+		t.Fatalf("expected lint to exclude only vite.config.ts")
+	}
+	if base.classify("vite.config.ts") != entryStage || len(base.exclude.rules) != 1 {
+		t.Fatalf("expected forCommand to leave the base filter alone")
+	}
+	if other := base.forCommand(config, "tsc"); other.classify("vite.config.ts") != entryStage {
+		t.Fatalf("expected commands without an entry to stage everything")
+	}
+}
+
+func TestCommandRulesLimitStaging(t *testing.T) {
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	name := commandName(os.Args[0])
+	cfg := `{"commands":{"` + name + `":{"include":["used.txt"]}}}`
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	for _, file := range []string{"used.txt", "unused.txt"} {
+		if err := os.WriteFile(filepath.Join(configDir, file), []byte(file), 0o644); err != nil {
+			t.Fatalf("write %s: %v", file, err)
+		}
+	}
+
+	code, stdout, stderr := runConfik(t, dir, append([]string{"--dry-run"}, testCommandArgs(0)...)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "would stage 1 file") || !strings.Contains(stdout, "skipped 1 file(s) not used by "+name) {
+		t.Fatalf("expected only the included file to be staged, got: %s", stdout)
+	}
+
+	code, stdout, stderr = runConfik(t, dir, append([]string{"--dry-run", "--all"}, testCommandArgs(0)...)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "would stage 2 file") || strings.Contains(stdout, "not used by") {
+		t.Fatalf("expected --all to stage every file, got: %s", stdout)
+	}
+}
+
 func TestVSCodeExcludeCleanupKeepsJSONCCommentOnly(t *testing.T) {
 	dir := t.TempDir()
 	staged := filepath.Join(dir, "example.txt")
@@ -885,3 +1198,26 @@ func TestHelperCommand(t *testing.T) {
 	}
 	os.Exit(code)
 }
+
+func TestIsSubcommand(t *testing.T) {
+	cases := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"ps"}, true},
+		{[]string{"ps", "aux"}, false},
+		{[]string{"gc"}, true},
+		{[]string{"gc", "--dry-run"}, true},
+		{[]string{"gc", "-v"}, false},
+		{[]string{"hooks", "check"}, true},
+		{[]string{"hooks", "--help"}, false},
+		{[]string{"--", "ps"}, false},
+		{[]string{"vite"}, false},
+		{nil, false},
+	}
+	for _, tc := range cases {
+		if got := isSubcommand(tc.args); got != tc.want {
+			t.Fatalf("isSubcommand(%q) = %v, want %v", tc.args, got, tc.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
 )
 
 type Manifest struct {
@@ -10,8 +11,12 @@ type Manifest struct {
 	CreatedFiles []string       `json:"createdFiles"`
 	CreatedDirs  []string       `json:"createdDirs"`
 	Gitignore    *GitContext    `json:"gitignore"`
+	Mercurial    *HgContext     `json:"mercurial,omitempty"`
 	VSCode       *VSCodeContext `json:"vscode,omitempty"`
+	SourceRef    string         `json:"sourceRef,omitempty"`
+	SourceCommit string         `json:"sourceCommit,omitempty"`
 	CreatedAt    string         `json:"createdAt"`
+	Participants []Participant  `json:"participants,omitempty"`
 }
 
 func writeManifest(pathname string, manifest Manifest) error {
@@ -35,3 +40,21 @@ func readManifest(pathname string) (*Manifest, error) {
 	}
 	return &manifest, nil
 }
+
+// stagedConfigFiles returns the files copied from .config/, relative to cwd.
+// It leaves out a .vscode/settings.json that confik created only to hold
+// the excludes.
+func stagedConfigFiles(cwd string, manifest *Manifest) []string {
+	settingsPath := ""
+	if manifest.VSCode != nil && manifest.VSCode.SettingsCreated {
+		settingsPath = manifest.VSCode.SettingsPath
+	}
+	files := []string{}
+	for _, rel := range manifest.CreatedFiles {
+		if settingsPath != "" && filepath.Join(cwd, filepath.FromSlash(rel)) == settingsPath {
+			continue
+		}
+		files = append(files, rel)
+	}
+	return files
+}
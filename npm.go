@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// packageScriptCommand is the command word that makes confik run a
+// package.json script instead of a program.
+const packageScriptCommand = "run"
+
+type packageJSON struct {
+	Scripts map[string]string `json:"scripts"`
+}
+
+// resolvePackageScript turns `confik run <script> [args...]` into a shell
+// command running the script from cwd/package.json, with args appended the
+// way npm run passes them on. A command after "--" is always a program, so
+// `confik -- run` still runs an executable called run.
+func resolvePackageScript(cwd string, parsed ParsedArgs) (ParsedArgs, error) {
+	if parsed.Command != packageScriptCommand || parsed.Separated || parsed.Flags.Parallel.Enabled || parsed.Flags.Shell {
+		return parsed, nil
+	}
+	pkgPath := filepath.Join(cwd, "package.json")
+	// #nosec G304 -- pkgPath is the package.json in the working directory.
+	data, err := os.ReadFile(pkgPath)
+	if err != nil {
+		return parsed, fmt.Errorf("confik run needs a package.json in %s (%v)", cwd, err)
+	}
+	var pkg packageJSON
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return parsed, fmt.Errorf("failed to parse %s (%v)", pkgPath, err)
+	}
+	if len(parsed.CommandArgs) == 0 {
+		return parsed, fmt.Errorf("missing script name; available scripts: %s", describeScripts(pkg.Scripts))
+	}
+	name := parsed.CommandArgs[0]
+	script, ok := pkg.Scripts[name]
+	if !ok {
+		return parsed, fmt.Errorf("no script %q in %s; available scripts: %s", name, pkgPath, describeScripts(pkg.Scripts))
+	}
+
+	line := script
+	for _, arg := range parsed.CommandArgs[1:] {
+		line += " " + shellQuote(arg)
+	}
+	parsed.Script = name
+	parsed.Command, parsed.CommandArgs = shellCommand(line)
+	if runtime.GOOS != "windows" {
+		// Scripts are written for sh, whatever the login shell is.
+		parsed.Command = "/bin/sh"
+	}
+	return parsed, nil
+}
+
+func describeScripts(scripts map[string]string) string {
+	if len(scripts) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(scripts))
+	for name := range scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// nodeBinEnv extends env with a PATH that has node_modules/.bin from cwd and
+// each of its ancestors in front, nearest first, like npm exec. Only the
+// command sees it: confik's own PATH is left alone. Directories that are
+// already on PATH stay where they are, so nested runs do not repeat them.
+func nodeBinEnv(cwd string, env func() []string) func() []string {
+	current := filepath.SplitList(os.Getenv("PATH"))
+	onPath := map[string]bool{}
+	for _, dir := range current {
+		onPath[dir] = true
+	}
+	dirs := []string{}
+	for dir := cwd; ; {
+		bin := filepath.Join(dir, "node_modules", ".bin")
+		if isDirectory(bin) && !onPath[bin] {
+			dirs = append(dirs, bin)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	if len(dirs) == 0 {
+		return env
+	}
+	path := "PATH=" + strings.Join(append(dirs, current...), string(filepath.ListSeparator))
+	return func() []string {
+		if env == nil {
+			return []string{path}
+		}
+		return append(env(), path)
+	}
+}
+
+// lookCommandPath resolves a bare command name against the PATH in cmd.Env,
+// which exec.Command cannot know about when it looks the command up.
+func lookCommandPath(cmd *exec.Cmd, command string) {
+	if strings.ContainsAny(command, `/\`) {
+		return
+	}
+	path := os.Getenv("PATH")
+	for _, kv := range cmd.Env {
+		if value, ok := strings.CutPrefix(kv, "PATH="); ok {
+			path = value
+		}
+	}
+	if path == os.Getenv("PATH") {
+		return
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			continue
+		}
+		if resolved, err := exec.LookPath(filepath.Join(dir, command)); err == nil {
+			cmd.Path, cmd.Err = resolved, nil
+			return
+		}
+	}
+}
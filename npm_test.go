@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func writePackageJSON(t *testing.T, dir, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(content), 0o644); err != nil {
+		t.Fatalf("write package.json: %v", err)
+	}
+}
+
+func TestResolvePackageScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("expects a POSIX shell")
+	}
+	dir := t.TempDir()
+	writePackageJSON(t, dir, `{"scripts":{"lint":"eslint .","test":"vitest run"}}`)
+
+	parsed, err := resolvePackageScript(dir, ParsedArgs{Command: "run", CommandArgs: []string{"test", "--reporter", "dot files"}})
+	if err != nil {
+		t.Fatalf("resolvePackageScript: %v", err)
+	}
+	if parsed.Command != "/bin/sh" || strings.Join(parsed.CommandArgs, "|") != "-c|vitest run --reporter 'dot files'" {
+		t.Fatalf("unexpected command: %s %v", parsed.Command, parsed.CommandArgs)
+	}
+
+	if _, err := resolvePackageScript(dir, ParsedArgs{Command: "run", CommandArgs: []string{"build"}}); err == nil || !strings.Contains(err.Error(), "lint, test") {
+		t.Fatalf("expected unknown script error listing scripts, got %v", err)
+	}
+	if _, err := resolvePackageScript(dir, ParsedArgs{Command: "run"}); err == nil {
+		t.Fatalf("expected error for a missing script name")
+	}
+	if _, err := resolvePackageScript(t.TempDir(), ParsedArgs{Command: "run", CommandArgs: []string{"test"}}); err == nil {
+		t.Fatalf("expected error without package.json")
+	}
+
+	separated := ParsedArgs{Command: "run", CommandArgs: []string{"test"}, Separated: true}
+	if parsed, err := resolvePackageScript(dir, separated); err != nil || parsed.Command != "run" {
+		t.Fatalf("expected run after -- to stay a program, got %#v (%v)", parsed, err)
+	}
+
+	untouched := ParsedArgs{Command: "vite", CommandArgs: []string{"run"}}
+	if parsed, err := resolvePackageScript(dir, untouched); err != nil || parsed.Command != "vite" {
+		t.Fatalf("expected other commands to pass through, got %#v (%v)", parsed, err)
+	}
+}
+
+func TestNodeBinEnv(t *testing.T) {
+	root := t.TempDir()
+	project := filepath.Join(root, "packages", "app")
+	for _, dir := range []string{filepath.Join(root, "node_modules", ".bin"), filepath.Join(project, "node_modules", ".bin")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	t.Setenv("PATH", "/usr/bin")
+
+	vars := nodeBinEnv(project, func() []string { return []string{"A=1"} })()
+	want := strings.Join([]string{filepath.Join(project, "node_modules", ".bin"), filepath.Join(root, "node_modules", ".bin"), "/usr/bin"}, string(filepath.ListSeparator))
+	if len(vars) != 2 || vars[0] != "A=1" || vars[1] != "PATH="+want {
+		t.Fatalf("vars = %v, want A=1 and PATH=%s", vars, want)
+	}
+	if got := os.Getenv("PATH"); got != "/usr/bin" {
+		t.Fatalf("expected confik's own PATH to stay unchanged, got %s", got)
+	}
+
+	t.Setenv("PATH", want)
+	if env := nodeBinEnv(project, nil); env != nil {
+		t.Fatalf("expected a nested run not to repeat directories, got %v", env())
+	}
+}
+
+func TestRunPackageScriptWithLocalBinaries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	binDir := filepath.Join(dir, "node_modules", ".bin")
+	for _, d := range []string{configDir, binDir} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(binDir, "localtool"), []byte("#!/bin/sh\ncat example.txt > seen.txt\necho \"$@\" >> seen.txt\n"), 0o755); err != nil {
+		t.Fatalf("write tool: %v", err)
+	}
+	writePackageJSON(t, dir, `{"scripts":{"check":"test -f example.txt && localtool --strict"}}`)
+
+	code, _, stderr := runConfik(t, dir, "run", "check", "extra arg")
+	if code != 0 {
+		t.Fatalf("expected script to succeed, got %d (stderr: %s)", code, stderr)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "seen.txt"))
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if string(data) != "hello--strict extra arg\n" {
+		t.Fatalf("unexpected tool output: %q", data)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "seen.txt")); err != nil {
+		t.Fatalf("remove output: %v", err)
+	}
+	code, _, stderr = runConfik(t, dir, "localtool", "direct")
+	if code != 0 {
+		t.Fatalf("expected local binary to be found, got %d (stderr: %s)", code, stderr)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "seen.txt")); err != nil || string(data) != "hellodirect\n" {
+		t.Fatalf("unexpected tool output: %q (%v)", data, err)
+	}
+
+	// After --, run is a program like any other.
+	if err := os.WriteFile(filepath.Join(binDir, "run"), []byte("#!/bin/sh\nexit 5\n"), 0o755); err != nil {
+		t.Fatalf("write run: %v", err)
+	}
+	code, _, stderr = runConfik(t, dir, "--", "run", "check")
+	if code != 5 {
+		t.Fatalf("expected the run executable to be used after --, got %d (stderr: %s)", code, stderr)
+	}
+
+	code, _, stderr = runConfik(t, dir, "-c", "localtool && exit 7")
+	if code != 7 {
+		t.Fatalf("expected shell command exit code 7, got %d (stderr: %s)", code, stderr)
+	}
+	if exists(filepath.Join(dir, "example.txt")) {
+		t.Fatalf("expected staged file to be cleaned up")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	successAll   = "all"
+	successFirst = "first"
+	successLast  = "last"
+)
+
+// ParallelOptions controls --parallel, where every command argument is a
+// separate shell command line.
+type ParallelOptions struct {
+	Enabled bool
+	// KillOthersOnFail stops the remaining commands once one exits non-zero.
+	KillOthersOnFail bool
+	// Success picks the overall exit code: all (the first failure, or 0),
+	// first (the first command to exit) or last (the last one to exit).
+	Success string
+}
+
+func validSuccessPolicy(policy string) bool {
+	switch policy {
+	case successAll, successFirst, successLast:
+		return true
+	}
+	return false
+}
+
+// prefixColors cycles through the ANSI colours used for command prefixes.
+var prefixColors = []string{"36", "35", "33", "32", "34", "31"}
+
+type parallelCommand struct {
+	line   string
+	prefix string
+	group  *processGroup
+
+	mu     sync.Mutex
+	done   bool
+	killed bool
+	code   int
+}
+
+func (c *parallelCommand) finish(code int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	c.code = code
+}
+
+// kill stops the command unless it has already exited, killing it if it is
+// still running after the grace period.
+func (c *parallelCommand) kill() {
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		return
+	}
+	c.killed = true
+	c.mu.Unlock()
+	c.group.stop(syscall.SIGTERM)
+	time.AfterFunc(timeoutGracePeriod, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if !c.done {
+			c.group.signal(syscall.SIGKILL)
+		}
+	})
+}
+
+// runParallel runs every command line at once, each in its own process group
+// with its output prefixed, and returns the exit code chosen by the success
+// policy once all of them have exited.
+func runParallel(lines []string, parallel ParallelOptions, opts commandOptions) int {
+	commands := make([]*parallelCommand, len(lines))
+	names := parallelNames(lines)
+	width := 0
+	for _, name := range names {
+		width = max(width, len(name))
+	}
+	color := isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
+	for i, line := range lines {
+		prefix := fmt.Sprintf("[%s]%s ", names[i], strings.Repeat(" ", width-len(names[i])))
+		if color {
+			prefix = "\x1b[" + prefixColors[i%len(prefixColors)] + "m" + prefix + "\x1b[0m"
+		}
+		commands[i] = &parallelCommand{line: line, prefix: prefix, group: &processGroup{}}
+	}
+
+	// The commands have process groups of their own, so terminal signals
+	// reach only confik and are passed on to each of them.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+	go func() {
+		for sig := range sigCh {
+			fmt.Fprintf(os.Stderr, "confik: received %s, forwarding to commands...\n", sig.String())
+			for _, c := range commands {
+				c.group.stop(sig)
+			}
+		}
+	}()
+
+	var outputMu sync.Mutex
+	exited := make(chan *parallelCommand, len(commands))
+	for _, c := range commands {
+		go func(c *parallelCommand) {
+			stdout := &prefixWriter{mu: &outputMu, dest: os.Stdout, prefix: c.prefix}
+			stderr := &prefixWriter{mu: &outputMu, dest: os.Stderr, prefix: c.prefix}
+			runOpts := opts
+			runOpts.Group = c.group
+			runOpts.Isolate = true
+			runOpts.Stdout = stdout
+			runOpts.Stderr = stderr
+			shell, args := shellCommand(c.line)
+			code, err := runCommand(shell, args, runOpts)
+			stdout.flush()
+			stderr.flush()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "confik: %s%v\n", c.prefix, err)
+			}
+			c.finish(code)
+			exited <- c
+		}(c)
+	}
+
+	order := make([]*parallelCommand, 0, len(commands))
+	killing := false
+	for range commands {
+		c := <-exited
+		order = append(order, c)
+		if c.code != 0 && parallel.KillOthersOnFail && !killing {
+			killing = true
+			fmt.Fprintf(os.Stderr, "confik: %s%s failed, stopping the other commands\n", c.prefix, c.line)
+			for _, other := range commands {
+				other.kill()
+			}
+		}
+	}
+
+	printParallelSummary(commands)
+	return parallelExitCode(order, parallel.Success)
+}
+
+// parallelExitCode applies the success policy to the commands in the order
+// they exited.
+func parallelExitCode(order []*parallelCommand, policy string) int {
+	if len(order) == 0 {
+		return 0
+	}
+	switch policy {
+	case successFirst:
+		return order[0].code
+	case successLast:
+		return order[len(order)-1].code
+	}
+	for _, c := range order {
+		if c.code != 0 {
+			return c.code
+		}
+	}
+	return 0
+}
+
+func printParallelSummary(commands []*parallelCommand) {
+	lines := []string{}
+	for _, c := range commands {
+		status := fmt.Sprintf("exited with code %d", c.code)
+		if c.killed {
+			status += " (stopped)"
+		}
+		lines = append(lines, fmt.Sprintf("confik: %s%s %s", c.prefix, c.line, status))
+	}
+	_, _ = fmt.Fprintln(os.Stdout, strings.Join(lines, "\n"))
+}
+
+// parallelNames labels each command line with the name of the program it
+// runs, adding its position when several run the same program.
+func parallelNames(lines []string) []string {
+	names := make([]string, len(lines))
+	counts := map[string]int{}
+	for i, line := range lines {
+		name := strings.Fields(line + " -")[0]
+		names[i] = filepath.Base(name)
+		counts[names[i]]++
+	}
+	for i, name := range names {
+		if counts[name] > 1 {
+			names[i] = fmt.Sprintf("%s#%d", name, i+1)
+		}
+	}
+	return names
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// prefixWriter writes whole lines to dest, each preceded by prefix. Writers
+// sharing mu never interleave within a line.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	dest   io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		end := bytes.IndexByte(w.buf, '\n')
+		if end < 0 {
+			break
+		}
+		w.writeLine(w.buf[:end+1])
+		w.buf = w.buf[end+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes a final line that did not end in a newline.
+func (w *prefixWriter) flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, _ = io.WriteString(w.dest, w.prefix)
+	_, _ = w.dest.Write(line)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParallelExitCode(t *testing.T) {
+	order := []*parallelCommand{{code: 0}, {code: 2}, {code: 0}, {code: 5}}
+	cases := map[string]int{successAll: 2, "": 2, successFirst: 0, successLast: 5}
+	for policy, want := range cases {
+		if got := parallelExitCode(order, policy); got != want {
+			t.Fatalf("parallelExitCode(%q) = %d, want %d", policy, got, want)
+		}
+	}
+	if got := parallelExitCode([]*parallelCommand{{code: 0}, {code: 0}}, successAll); got != 0 {
+		t.Fatalf("expected 0 when every command succeeds, got %d", got)
+	}
+}
+
+func TestParallelNames(t *testing.T) {
+	got := parallelNames([]string{"vite", "./node_modules/.bin/tsc --watch", "vite build", ""})
+	want := []string{"vite#1", "tsc", "vite#3", "-"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("parallelNames = %v, want %v", got, want)
+	}
+}
+
+func TestPrefixWriterWritesWholeLines(t *testing.T) {
+	var out bytes.Buffer
+	w := &prefixWriter{mu: &sync.Mutex{}, dest: &out, prefix: "[a] "}
+	_, _ = w.Write([]byte("one\ntw"))
+	_, _ = w.Write([]byte("o\nthree"))
+	if out.String() != "[a] one\n[a] two\n" {
+		t.Fatalf("unexpected output before flush: %q", out.String())
+	}
+	w.flush()
+	if out.String() != "[a] one\n[a] two\n[a] three\n" {
+		t.Fatalf("unexpected output after flush: %q", out.String())
+	}
+}
+
+func TestParallelRunsCommandsUnderOneStaging(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	code, stdout, stderr := runConfik(t, dir, "--parallel", "--", "cat example.txt", "printf 'two\\n'; exit 3")
+	if code != 3 {
+		t.Fatalf("expected the failing command's exit code 3, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "[cat]    hello\n") || !strings.Contains(stdout, "[printf] two\n") {
+		t.Fatalf("expected prefixed output, got: %s", stdout)
+	}
+	if !strings.Contains(stdout, "cat example.txt exited with code 0") || !strings.Contains(stdout, "exit 3 exited with code 3") {
+		t.Fatalf("expected a per-command summary, got: %s", stdout)
+	}
+	if exists(filepath.Join(dir, "example.txt")) {
+		t.Fatalf("expected staged file to be cleaned up")
+	}
+
+	code, _, stderr = runConfik(t, dir, "--parallel", "--success", "first", "--", "exit 4", "sleep 0.5; exit 0")
+	if code != 4 {
+		t.Fatalf("expected the first command's exit code 4, got %d (stderr: %s)", code, stderr)
+	}
+}
+
+func TestParallelKillOthersOnFail(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".config"), 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+
+	start := time.Now()
+	code, stdout, stderr := runConfik(t, dir, "--parallel", "--kill-others-on-fail", "--", "sleep 30", "exit 2")
+	if code != 2 {
+		t.Fatalf("expected exit code 2, got %d (stderr: %s)", code, stderr)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("expected the sleeping command to be stopped")
+	}
+	if !strings.Contains(stdout, "sleep 30 exited with code 143 (stopped)") {
+		t.Fatalf("expected the stopped command in the summary, got: %s", stdout)
+	}
+}
+
+func TestParallelIgnoresBackgroundProcessHoldingOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".config"), 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+
+	// The background sleep keeps the output pipe open after its shell exits.
+	code, stdout, stderr := runConfik(t, dir, "--parallel", "--", "(exec sleep 5 &); exit 0", "true")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stdout: %s, stderr: %s)", code, stdout, stderr)
+	}
+	if !strings.Contains(stdout, "exit 0 exited with code 0") || strings.Contains(stderr, "WaitDelay") {
+		t.Fatalf("expected the command to count as exited cleanly, got: %s%s", stdout, stderr)
+	}
+}
+
+func TestParallelIgnoresConfigWaitTree(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(`{"waitTree":true}`), 0o644); err != nil {
+		t.Fatalf("write confik.json: %v", err)
+	}
+
+	// With a shared tree, each command would wait for the other one too.
+	code, _, stderr := runConfik(t, dir, "--parallel", "--", "sleep 0.5", "(sleep 1 >/dev/null 2>&1 &); exit 0")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if strings.Contains(stderr, "background process") {
+		t.Fatalf("expected waitTree not to apply to --parallel, got: %s", stderr)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+// processRunning reports whether pid is alive and, when a start ID was
+// recorded, still refers to the same process instance rather than a new
+// process that reused the pid.
+func processRunning(pid int, startID string) bool {
+	if !processAlive(pid) {
+		return false
+	}
+	if startID == "" {
+		return true
+	}
+	current := processStartID(pid)
+	return current == "" || current == startID
+}
@@ -0,0 +1,20 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// processStartID identifies a process instance so that a recycled pid is not
+// mistaken for the original process. On macOS it is the kernel start time.
+func processStartID(pid int) string {
+	info, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	if err != nil || info.Proc.P_pid != int32(pid) {
+		return ""
+	}
+	start := info.Proc.P_starttime
+	return fmt.Sprintf("%d.%06d", start.Sec, start.Usec)
+}
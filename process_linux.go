@@ -0,0 +1,31 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// processStartID identifies a process instance so that a recycled pid is not
+// mistaken for the original process. On Linux it is the start time in clock
+// ticks since boot from /proc/<pid>/stat.
+func processStartID(pid int) string {
+	// #nosec G304 -- path is built from a numeric pid.
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ""
+	}
+	// The command name may contain spaces and parentheses; fields resume after the last ')'.
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return ""
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	// starttime is field 22 of stat; fields here start at field 3 (state).
+	if len(fields) < 20 {
+		return ""
+	}
+	return fields[19]
+}
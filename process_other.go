@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+// processStartID is not available on this platform; pid reuse is not detected.
+func processStartID(pid int) string {
+	return ""
+}
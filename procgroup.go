@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// processGroup remembers the running command so that signals can be passed
+// on to it. When the command runs in a process group of its own (job control,
+// --wait-tree or --timeout) the whole group is signalled.
+type processGroup struct {
+	mu       sync.Mutex
+	pid      int
+	isolated bool
+	stopping bool
+	// bouncing is set while the command is being stopped to be started again.
+	bouncing bool
+}
+
+func (g *processGroup) set(pid int, isolated bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pid = pid
+	g.isolated = isolated
+}
+
+// exited forgets the command started as pid once it has been reaped, so that
+// a signal arriving before the next start (say during a restart backoff)
+// cannot reach a process or group that has since taken over the pid.
+func (g *processGroup) exited(pid int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pid == pid {
+		g.pid = 0
+		g.isolated = false
+	}
+}
+
+// hasOwnGroup reports whether the command is out of reach of signals aimed
+// at confik's process group, such as Ctrl+C when confik is not a job of its own.
+func (g *processGroup) hasOwnGroup() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.pid > 0 && g.isolated
+}
+
+func (g *processGroup) signal(sig os.Signal) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pid > 0 {
+		signalProcess(g.pid, sig, g.isolated)
+	}
+}
+
+// stop signals the command and records that it is meant to end, so that a
+// --restart policy does not bring it back.
+func (g *processGroup) stop(sig os.Signal) {
+	g.requestStop()
+	g.signal(sig)
+}
+
+func (g *processGroup) requestStop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.stopping = true
+}
+
+func (g *processGroup) stopRequested() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stopping
+}
+
+// bounce signals the command so that it exits and is started again, and
+// returns the pid it signalled.
+func (g *processGroup) bounce(sig os.Signal) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pid > 0 {
+		g.bouncing = true
+		signalProcess(g.pid, sig, g.isolated)
+	}
+	return g.pid
+}
+
+// stillBouncing reports whether the command started as pid has not exited
+// since it was bounced.
+func (g *processGroup) stillBouncing(pid int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.bouncing && g.pid == pid
+}
+
+// takeBounce reports whether the command that just exited had been bounced,
+// and clears the request.
+func (g *processGroup) takeBounce() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	bounced := g.bouncing
+	g.bouncing = false
+	return bounced
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func isolateProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func hasOwnProcessGroup(cmd *exec.Cmd) bool {
+	return cmd.SysProcAttr != nil && (cmd.SysProcAttr.Setpgid || cmd.SysProcAttr.Foreground)
+}
+
+func signalProcess(pid int, sig os.Signal, group bool) {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return
+	}
+	if group {
+		pid = -pid
+	}
+	_ = syscall.Kill(pid, s)
+}
@@ -0,0 +1,29 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// isolateProcessGroup is a no-op on Windows; console process groups do not
+// receive signals the way Unix process groups do.
+func isolateProcessGroup(cmd *exec.Cmd) {}
+
+func hasOwnProcessGroup(cmd *exec.Cmd) bool {
+	return false
+}
+
+// signalProcess can only terminate the command on Windows, so any signal other
+// than an interrupt ends it.
+func signalProcess(pid int, sig os.Signal, group bool) {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return
+	}
+	if sig == os.Interrupt {
+		return
+	}
+	_ = process.Kill()
+}
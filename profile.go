@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// envProfile selects a profile when --profile is not given.
+const envProfile = "CONFIK_PROFILE"
+
+// Profile is a named set of overrides in confik.json, applied on top of the
+// top-level settings. Extends names a profile applied before this one.
+type Profile struct {
+	Extends       string   `json:"extends"`
+	Exclude       []string `json:"exclude"`
+	Include       []string `json:"include"`
+	Registry      *bool    `json:"registry"`
+	Gitignore     *bool    `json:"gitignore"`
+	VSCodeExclude *bool    `json:"vscodeExclude"`
+}
+
+// resolveProfileName picks the profile from --profile, then the environment.
+func resolveProfileName(flag string) string {
+	if flag != "" {
+		return flag
+	}
+	return os.Getenv(envProfile)
+}
+
+// applyProfile returns config with the named profile and the profiles it
+// extends applied, base first. An empty name leaves config unchanged.
+func applyProfile(config ConfikConfig, name string) (ConfikConfig, error) {
+	if name == "" {
+		return config, nil
+	}
+	chain := []Profile{}
+	seen := map[string]bool{}
+	for current := name; current != ""; {
+		if seen[current] {
+			return config, fmt.Errorf("profile %q in %s extends itself", current, config.Path)
+		}
+		seen[current] = true
+		profile, ok := config.Profiles[current]
+		if !ok {
+			return config, fmt.Errorf("unknown profile %q in %s; available profiles: %s", current, config.Path, describeProfiles(config.Profiles))
+		}
+		chain = append(chain, profile)
+		current = profile.Extends
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		profile := chain[i]
+		if profile.Exclude != nil {
+			config.Exclude = profile.Exclude
+		}
+		if profile.Include != nil {
+			config.Include = profile.Include
+		}
+		if profile.Registry != nil {
+			config.Registry = *profile.Registry
+		}
+		if profile.Gitignore != nil {
+			config.Gitignore = *profile.Gitignore
+		}
+		if profile.VSCodeExclude != nil {
+			config.VSCodeExclude = *profile.VSCodeExclude
+		}
+	}
+	config.Profile = name
+	return config, nil
+}
+
+func describeProfiles(profiles map[string]Profile) string {
+	if len(profiles) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyProfile(t *testing.T) {
+	off := false
+	config := defaultConfig("confik.json")
+	config.Exclude = []string{"*.local"}
+	config.Profiles = map[string]Profile{
+		"ci":    {Exclude: []string{"*.secret"}, Registry: &off},
+		"e2e":   {Extends: "ci", Include: []string{"playwright.config.ts"}},
+		"loop":  {Extends: "knot"},
+		"knot":  {Extends: "loop"},
+		"stray": {Extends: "missing"},
+	}
+
+	got, err := applyProfile(config, "e2e")
+	if err != nil {
+		t.Fatalf("applyProfile: %v", err)
+	}
+	if got.Profile != "e2e" || got.Registry || strings.Join(got.Exclude, ",") != "*.secret" || strings.Join(got.Include, ",") != "playwright.config.ts" {
+		t.Fatalf("unexpected config for e2e: %#v", got)
+	}
+	if !got.Gitignore {
+		t.Fatalf("expected settings the profiles leave alone to keep their value")
+	}
+
+	if got, err := applyProfile(config, ""); err != nil || got.Profile != "" || strings.Join(got.Exclude, ",") != "*.local" {
+		t.Fatalf("expected no profile to leave the config alone: %#v (%v)", got, err)
+	}
+	if _, err := applyProfile(config, "loop"); err == nil || !strings.Contains(err.Error(), "extends itself") {
+		t.Fatalf("expected a cycle error, got %v", err)
+	}
+	if _, err := applyProfile(config, "stray"); err == nil || !strings.Contains(err.Error(), "available profiles: ci, e2e") {
+		t.Fatalf("expected an unknown profile error, got %v", err)
+	}
+}
+
+func TestResolveProfileName(t *testing.T) {
+	t.Setenv(envProfile, "ci")
+	if got := resolveProfileName(""); got != "ci" {
+		t.Fatalf("expected the environment profile, got %q", got)
+	}
+	if got := resolveProfileName("dev"); got != "dev" {
+		t.Fatalf("expected --profile to win, got %q", got)
+	}
+}
+
+func TestProfileSelectsStagedFiles(t *testing.T) {
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	cfg := `{"profiles":{"ci":{"include":["ci.txt"]}}}`
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	for _, file := range []string{"ci.txt", "dev.txt"} {
+		if err := os.WriteFile(filepath.Join(configDir, file), []byte(file), 0o644); err != nil {
+			t.Fatalf("write %s: %v", file, err)
+		}
+	}
+
+	code, stdout, stderr := runConfik(t, dir, append([]string{"--dry-run", "--profile", "ci"}, testCommandArgs(0)...)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "using profile ci") || !strings.Contains(stdout, "would stage 1 file") || !strings.Contains(stdout, "excluded 1 file") {
+		t.Fatalf("expected the ci profile to stage only ci.txt, got: %s", stdout)
+	}
+
+	t.Setenv(envProfile, "nightly")
+	if code, _, _ := runConfik(t, dir, append([]string{"--dry-run"}, testCommandArgs(0)...)...); code == 0 {
+		t.Fatalf("expected an unknown profile from the environment to fail")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Environment markers exported to the wrapped command so that a nested confik
+// invocation can tell that its .config is already staged by an ancestor.
+const (
+	envRunID     = "CONFIK_RUN_ID"
+	envConfigDir = "CONFIK_CONFIG_DIR"
+	envLockPID   = "CONFIK_LOCK_PID"
+)
+
+func confikEnv(runID, configDir string) []string {
+	return []string{
+		envRunID + "=" + runID,
+		envConfigDir + "=" + canonicalPath(configDir),
+		envLockPID + "=" + strconv.Itoa(os.Getpid()),
+	}
+}
+
+// detectEnclosingRun reports whether an ancestor confik process is attached to
+// the staging for configDir. The environment alone is not trusted: the manifest
+// must still carry the advertised run ID and list the pid as a live
+// participant, so stale markers leaking into a long-lived shell fall back to
+// normal locking.
+func detectEnclosingRun(configDir, manifestPath string) (string, bool) {
+	runID := os.Getenv(envRunID)
+	if runID == "" || os.Getenv(envConfigDir) != canonicalPath(configDir) {
+		return "", false
+	}
+	pid, err := strconv.Atoi(os.Getenv(envLockPID))
+	if err != nil || pid == os.Getpid() {
+		return "", false
+	}
+	manifest, err := readManifest(manifestPath)
+	if err != nil || manifest.RunID != runID {
+		return "", false
+	}
+	if !hasParticipant(liveParticipants(manifest.Participants), pid) {
+		return "", false
+	}
+	return runID, true
+}
+
+func canonicalPath(pathname string) string {
+	abs, err := filepath.Abs(pathname)
+	if err != nil {
+		return pathname
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectEnclosingRun(t *testing.T) {
+	configDir := t.TempDir()
+	manifestPath := filepath.Join(configDir, manifestFilename)
+	owner := os.Getppid()
+	writeParticipants := func(runID string, pids ...int) {
+		t.Helper()
+		manifest := Manifest{RunID: runID}
+		for _, pid := range pids {
+			manifest.Participants = append(manifest.Participants, Participant{PID: pid})
+		}
+		if err := writeManifest(manifestPath, manifest); err != nil {
+			t.Fatalf("write manifest: %v", err)
+		}
+	}
+
+	t.Setenv(envRunID, "outer")
+	t.Setenv(envConfigDir, canonicalPath(configDir))
+	t.Setenv(envLockPID, strconv.Itoa(owner))
+	writeParticipants("outer", owner)
+
+	if runID, ok := detectEnclosingRun(configDir, manifestPath); !ok || runID != "outer" {
+		t.Fatalf("expected enclosing run, got %q %v", runID, ok)
+	}
+
+	if _, ok := detectEnclosingRun(t.TempDir(), manifestPath); ok {
+		t.Fatalf("expected different .config to be treated as a separate run")
+	}
+
+	writeParticipants("other", owner)
+	if _, ok := detectEnclosingRun(configDir, manifestPath); ok {
+		t.Fatalf("expected run ID mismatch to disable reentry")
+	}
+
+	dead := exec.Command(os.Args[0], "-test.run=^$")
+	if err := dead.Run(); err != nil {
+		t.Fatalf("run short-lived process: %v", err)
+	}
+	t.Setenv(envLockPID, strconv.Itoa(dead.Process.Pid))
+	writeParticipants("outer", dead.Process.Pid)
+	if _, ok := detectEnclosingRun(configDir, manifestPath); ok {
+		t.Fatalf("expected dead owner to disable reentry")
+	}
+}
+
+func TestNestedInvocationReusesStaging(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh to run the nested invocation")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	inner := fmt.Sprintf("'%s' -test.run=TestHelperProcess -- sh -c 'test -f example.txt'", os.Args[0])
+	script := inner + " && test -f example.txt && test -f .config/" + manifestFilename
+
+	done := make(chan struct{})
+	var code int
+	var stderr string
+	go func() {
+		code, _, stderr = runConfik(t, dir, "sh", "-c", script)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("nested confik invocation deadlocked")
+	}
+
+	if code != 0 {
+		t.Fatalf("expected nested run to see and keep staging, got %d (stderr: %s)", code, stderr)
+	}
+	if strings.Contains(stderr, "waiting for lock") {
+		t.Fatalf("did not expect nested run to wait for the lock: %s", stderr)
+	}
+	if exists(filepath.Join(dir, "example.txt")) {
+		t.Fatalf("expected outer run to clean up")
+	}
+}
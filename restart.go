@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	restartNever     = "no"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+)
+
+const (
+	restartInitialBackoff = time.Second
+	restartMaxBackoff     = 30 * time.Second
+	// restartStableAfter resets the backoff for a command that ran at least
+	// this long before exiting.
+	restartStableAfter = 30 * time.Second
+)
+
+// RestartPolicy controls whether a command that exits is started again while
+// its staging stays in place.
+type RestartPolicy struct {
+	Mode string
+	// Max is the number of restarts allowed; 0 means no limit.
+	Max int
+}
+
+func validRestartMode(mode string) bool {
+	switch mode {
+	case restartNever, restartOnFailure, restartAlways:
+		return true
+	}
+	return false
+}
+
+// shouldRestart reports whether a run that ended with code is restarted. A
+// command stopped by confik or interrupted with Ctrl+C is never restarted.
+func (p RestartPolicy) shouldRestart(code int, group *processGroup) bool {
+	if group.stopRequested() || code == 128+int(syscall.SIGINT) {
+		return false
+	}
+	switch p.Mode {
+	case restartOnFailure:
+		return code != 0
+	case restartAlways:
+		return true
+	}
+	return false
+}
+
+// runWithRestarts runs the command and, depending on the restart policy,
+// starts it again with exponential backoff until it succeeds, is stopped or
+// the restart budget runs out. It returns the exit code of the last run.
+func runWithRestarts(command string, args []string, opts commandOptions) (int, error) {
+	if opts.Group == nil {
+		opts.Group = &processGroup{}
+	}
+	backoff := restartInitialBackoff
+	for restarts := 0; ; restarts++ {
+		started := time.Now()
+		code, err := runCommand(command, args, opts)
+		if err == nil && opts.Group.takeBounce() && !opts.Group.stopRequested() {
+			// Restarts asked for by --watch-restart do not count against the
+			// budget or back off.
+			restarts--
+			continue
+		}
+		if err != nil || !opts.Restart.shouldRestart(code, opts.Group) {
+			return code, err
+		}
+		if opts.Restart.Max > 0 && restarts >= opts.Restart.Max {
+			fmt.Fprintf(os.Stderr, "confik: %s exited with code %d; restart limit (%d) reached, giving up\n", command, code, opts.Restart.Max)
+			return code, nil
+		}
+		if time.Since(started) >= restartStableAfter {
+			backoff = restartInitialBackoff
+		}
+		fmt.Fprintf(os.Stderr, "confik: %s exited with code %d, restarting in %s (%s)\n", command, code, backoff, describeRestart(restarts+1, opts.Restart.Max))
+		if !sleepUnlessStopped(backoff, opts.Group) {
+			return code, nil
+		}
+		backoff *= 2
+		if backoff > restartMaxBackoff {
+			backoff = restartMaxBackoff
+		}
+	}
+}
+
+func describeRestart(n, max int) string {
+	if max > 0 {
+		return fmt.Sprintf("restart %d/%d", n, max)
+	}
+	return fmt.Sprintf("restart %d", n)
+}
+
+// sleepUnlessStopped waits for d and reports false if a stop was requested
+// in the meantime.
+func sleepUnlessStopped(d time.Duration, group *processGroup) bool {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if group.stopRequested() {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return !group.stopRequested()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRestartPolicyShouldRestart(t *testing.T) {
+	group := &processGroup{}
+	cases := []struct {
+		mode string
+		code int
+		want bool
+	}{
+		{restartNever, 1, false},
+		{restartOnFailure, 0, false},
+		{restartOnFailure, 1, true},
+		{restartOnFailure, 137, true},
+		{restartOnFailure, 130, false},
+		{restartAlways, 0, true},
+	}
+	for _, tc := range cases {
+		if got := (RestartPolicy{Mode: tc.mode}).shouldRestart(tc.code, group); got != tc.want {
+			t.Fatalf("shouldRestart(%s, %d) = %v, want %v", tc.mode, tc.code, got, tc.want)
+		}
+	}
+
+	group.requestStop()
+	if (RestartPolicy{Mode: restartAlways}).shouldRestart(1, group) {
+		t.Fatalf("expected no restart after a stop was requested")
+	}
+}
+
+func TestRestartKeepsStagingUntilBudgetRunsOut(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	script := `test -f example.txt && echo staged >> runs.txt; exit 3`
+	code, _, stderr := runConfik(t, dir, "--restart", "on-failure", "--max-restarts", "2", "sh", "-c", script)
+	if code != 3 {
+		t.Fatalf("expected exit code 3, got %d (stderr: %s)", code, stderr)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "runs.txt"))
+	if err != nil {
+		t.Fatalf("read runs: %v", err)
+	}
+	if runs := strings.Count(string(data), "staged"); runs != 3 {
+		t.Fatalf("expected 3 runs with staged files, got %d", runs)
+	}
+	if !strings.Contains(stderr, "restart 2/2") || !strings.Contains(stderr, "restart limit (2) reached") {
+		t.Fatalf("unexpected restart output: %s", stderr)
+	}
+	if exists(filepath.Join(dir, "example.txt")) {
+		t.Fatalf("expected staged file to be cleaned up once restarts ran out")
+	}
+}
+
+func TestRestartOnFailureStopsAfterSuccess(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".config"), 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+
+	script := `echo run >> runs.txt; [ "$(wc -l < runs.txt)" -ge 2 ]`
+	code, _, stderr := runConfik(t, dir, "--restart=on-failure", "sh", "-c", script)
+	if code != 0 {
+		t.Fatalf("expected success on the second run, got %d (stderr: %s)", code, stderr)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "runs.txt"))
+	if err != nil {
+		t.Fatalf("read runs: %v", err)
+	}
+	if runs := strings.Count(string(data), "run"); runs != 2 {
+		t.Fatalf("expected 2 runs, got %d", runs)
+	}
+}
+
+func TestRunCommandForgetsExitedCommand(t *testing.T) {
+	t.Setenv("CONFIK_CMD", "1")
+	group := &processGroup{}
+	args := testCommandArgs(3)
+	code, err := runCommand(args[0], args[1:], commandOptions{Group: group, Isolate: true})
+	if err != nil || code != 3 {
+		t.Fatalf("runCommand = %d, %v", code, err)
+	}
+	// A signal during the restart backoff must not reach a recycled pid.
+	group.mu.Lock()
+	pid := group.pid
+	group.mu.Unlock()
+	if pid != 0 || group.hasOwnGroup() {
+		t.Fatalf("expected the exited command to be forgotten, still have pid %d", pid)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Variables describing the staging to the wrapped command, alongside the
+// reentry markers from confikEnv.
+const (
+	envRoot     = "CONFIK_ROOT"
+	envManifest = "CONFIK_MANIFEST"
+	envStaged   = "CONFIK_STAGED"
+)
+
+// runEnv tells the wrapped command what confik staged, through its
+// environment and, with --env-file, a KEY=value file.
+type runEnv struct {
+	runID        string
+	cwd          string
+	configDir    string
+	manifestPath string
+	envFile      string
+	// extra holds variables set by inject rules.
+	extra []string
+}
+
+// vars returns the variables for a command about to start. The staged list
+// is read from the manifest each time, so a command restarted under --watch
+// sees the current set. Paths in CONFIK_STAGED are relative to CONFIK_ROOT
+// and separated like PATH entries.
+func (e *runEnv) vars() []string {
+	vars := confikEnv(e.runID, e.configDir)
+	vars = append(vars, envRoot+"="+e.cwd, envManifest+"="+e.manifestPath)
+	staged := []string{}
+	if manifest, err := readManifest(e.manifestPath); err == nil {
+		staged = stagedConfigFiles(e.cwd, manifest)
+	}
+	vars = append(vars, envStaged+"="+strings.Join(staged, string(filepath.ListSeparator)))
+	return append(vars, e.extra...)
+}
+
+func (e *runEnv) writeFile() error {
+	if e.envFile == "" {
+		return nil
+	}
+	return os.WriteFile(e.envFile, []byte(strings.Join(e.vars(), "\n")+"\n"), 0o600)
+}
+
+// removeFile deletes the env file once the staging it describes is gone.
+func (e *runEnv) removeFile() error {
+	if e.envFile == "" {
+		return nil
+	}
+	if err := os.Remove(e.envFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
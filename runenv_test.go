@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func envValue(vars []string, key string) (string, bool) {
+	for _, kv := range vars {
+		if name, value, ok := strings.Cut(kv, "="); ok && name == key {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func TestRunEnvVars(t *testing.T) {
+	cwd := t.TempDir()
+	manifestPath := filepath.Join(cwd, manifestFilename)
+	env := &runEnv{runID: "run-1", cwd: cwd, configDir: filepath.Join(cwd, ".config"), manifestPath: manifestPath}
+
+	if staged, ok := envValue(env.vars(), envStaged); !ok || staged != "" {
+		t.Fatalf("expected empty %s without a manifest, got %q (%v)", envStaged, staged, ok)
+	}
+
+	manifest := Manifest{
+		RunID:        "run-1",
+		CreatedFiles: []string{"a.txt", "sub/b.txt", ".vscode/settings.json"},
+		VSCode:       &VSCodeContext{SettingsPath: filepath.Join(cwd, ".vscode", "settings.json"), SettingsCreated: true},
+	}
+	if err := writeManifest(manifestPath, manifest); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	vars := env.vars()
+	want := map[string]string{
+		envRunID:    "run-1",
+		envRoot:     cwd,
+		envManifest: manifestPath,
+		envStaged:   "a.txt" + string(filepath.ListSeparator) + "sub/b.txt",
+	}
+	for key, value := range want {
+		if got, _ := envValue(vars, key); got != value {
+			t.Fatalf("%s = %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestStagingDetailsReachCommandAndEnvFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(filepath.Join(configDir, "sub"), 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	for _, name := range []string{"a.txt", filepath.Join("sub", "b.txt")} {
+		if err := os.WriteFile(filepath.Join(configDir, name), []byte("x"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	script := `printf '%s\n' "$CONFIK_ROOT" "$CONFIK_STAGED" "$CONFIK_MANIFEST" > seen.txt; cp confik.env env-copy.txt`
+	code, _, stderr := runConfik(t, dir, "--env-file", "confik.env", "sh", "-c", script)
+	if code != 0 {
+		t.Fatalf("expected success, got %d (stderr: %s)", code, stderr)
+	}
+
+	seen, err := os.ReadFile(filepath.Join(dir, "seen.txt"))
+	if err != nil {
+		t.Fatalf("read seen.txt: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(seen)), "\n")
+	if len(lines) != 3 || lines[0] != dir || lines[1] != "a.txt:sub/b.txt" || lines[2] != filepath.Join(configDir, manifestFilename) {
+		t.Fatalf("unexpected staging details: %q", lines)
+	}
+
+	envFile, err := os.ReadFile(filepath.Join(dir, "env-copy.txt"))
+	if err != nil {
+		t.Fatalf("read env file copy: %v", err)
+	}
+	for _, want := range []string{envRunID + "=", envRoot + "=" + dir + "\n", envStaged + "=a.txt:sub/b.txt\n"} {
+		if !strings.Contains(string(envFile), want) {
+			t.Fatalf("expected env file to contain %q, got: %s", want, envFile)
+		}
+	}
+	if exists(filepath.Join(dir, "confik.env")) {
+		t.Fatalf("expected env file to be removed with the staging")
+	}
+}
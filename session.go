@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Participant is a confik process sharing the staging described by a manifest.
+// The staging is removed when the last live participant detaches.
+type Participant struct {
+	PID       int    `json:"pid"`
+	StartID   string `json:"startId,omitempty"`
+	StartedAt string `json:"startedAt"`
+	Command   string `json:"command,omitempty"`
+}
+
+func newParticipant(command string, args []string) Participant {
+	return Participant{
+		PID:       os.Getpid(),
+		StartID:   processStartID(os.Getpid()),
+		StartedAt: time.Now().UTC().Format(time.RFC3339),
+		Command:   strings.TrimSpace(strings.Join(append([]string{command}, args...), " ")),
+	}
+}
+
+// liveParticipants drops participants whose process is gone (or whose pid now
+// belongs to another process), so a crashed run cannot keep the staging alive.
+func liveParticipants(participants []Participant) []Participant {
+	live := []Participant{}
+	for _, p := range participants {
+		if processRunning(p.PID, p.StartID) {
+			live = append(live, p)
+		}
+	}
+	return live
+}
+
+func hasParticipant(participants []Participant, pid int) bool {
+	for _, p := range participants {
+		if p.PID == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// attachSession joins an active staging. The caller must hold the lock. It
+// returns nil when the manifest is missing or has no live participants, and
+// an error when the staging came from another source than sourceRef (the
+// --from-ref value, empty for the working tree).
+func attachSession(manifestPath string, self Participant, sourceRef string) (*Manifest, error) {
+	manifest, err := readManifest(manifestPath)
+	if err != nil {
+		return nil, nil
+	}
+	live := liveParticipants(manifest.Participants)
+	if len(live) == 0 {
+		return nil, nil
+	}
+	if err := checkSessionSource(manifest, sourceRef); err != nil {
+		return nil, err
+	}
+	manifest.Participants = append(live, self)
+	if err := writeManifest(manifestPath, *manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// checkSessionSource fails when an active staging was made from a different
+// source than sourceRef, so that a run never sees another ref's configs.
+func checkSessionSource(manifest *Manifest, sourceRef string) error {
+	if manifest.SourceRef == sourceRef {
+		return nil
+	}
+	return fmt.Errorf("run %s staged .config from %s, not %s; wait for it to finish before running with a different source", manifest.RunID, describeSource(manifest.SourceRef), describeSource(sourceRef))
+}
+
+func describeSource(ref string) string {
+	if ref == "" {
+		return "the working tree"
+	}
+	return fmt.Sprintf("--from-ref %s", ref)
+}
+
+// detachSession removes pid from the participants. The caller must hold the
+// lock. It returns the manifest when pid was the last live participant and
+// the staging should be cleaned up, or nil when others are still attached.
+func detachSession(manifestPath string, pid int) (*Manifest, error) {
+	manifest, err := readManifest(manifestPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	remaining := []Participant{}
+	for _, p := range liveParticipants(manifest.Participants) {
+		if p.PID != pid {
+			remaining = append(remaining, p)
+		}
+	}
+	if len(remaining) > 0 {
+		manifest.Participants = remaining
+		return nil, writeManifest(manifestPath, *manifest)
+	}
+	manifest.Participants = nil
+	return manifest, nil
+}
+
+func describeParticipants(participants []Participant) string {
+	parts := make([]string, 0, len(participants))
+	for _, p := range participants {
+		if p.Command != "" {
+			parts = append(parts, fmt.Sprintf("pid %d (%s)", p.PID, p.Command))
+		} else {
+			parts = append(parts, fmt.Sprintf("pid %d", p.PID))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
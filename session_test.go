@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startConfik(t *testing.T, dir string, args ...string) (*exec.Cmd, *bytes.Buffer) {
+	t.Helper()
+
+	cmdArgs := append([]string{"-test.run=TestHelperProcess", "--"}, args...)
+	cmd := exec.Command(os.Args[0], cmdArgs...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CONFIK_HELPER=1", "CONFIK_CMD=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start confik: %v", err)
+	}
+	t.Cleanup(func() {
+		if cmd.ProcessState == nil {
+			_ = cmd.Process.Kill()
+			_, _ = cmd.Process.Wait()
+		}
+	})
+	return cmd, &output
+}
+
+func waitForPath(t *testing.T, pathname string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if exists(pathname) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%s did not appear before timeout", pathname)
+}
+
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run short-lived process: %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestAttachAndDetachSession(t *testing.T) {
+	manifestPath := filepath.Join(t.TempDir(), manifestFilename)
+	self := Participant{PID: os.Getpid()}
+
+	if manifest, err := attachSession(manifestPath, self, ""); err != nil || manifest != nil {
+		t.Fatalf("expected no session without manifest, got %v, %v", manifest, err)
+	}
+
+	crashed := Manifest{RunID: "crashed", Participants: []Participant{{PID: deadPID(t)}}}
+	if err := writeManifest(manifestPath, crashed); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	if manifest, err := attachSession(manifestPath, self, ""); err != nil || manifest != nil {
+		t.Fatalf("expected crashed session to be treated as stale, got %v, %v", manifest, err)
+	}
+
+	live := Manifest{RunID: "live", Participants: []Participant{{PID: os.Getppid()}, {PID: deadPID(t)}}}
+	if err := writeManifest(manifestPath, live); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	manifest, err := attachSession(manifestPath, self, "")
+	if err != nil || manifest == nil {
+		t.Fatalf("expected to attach, got %v, %v", manifest, err)
+	}
+	if len(manifest.Participants) != 2 || !hasParticipant(manifest.Participants, self.PID) {
+		t.Fatalf("expected dead participant pruned and self added, got %#v", manifest.Participants)
+	}
+
+	if _, err := attachSession(manifestPath, Participant{PID: os.Getpid() + 1}, "v1.0.0"); err == nil || !strings.Contains(err.Error(), "from the working tree, not --from-ref v1.0.0") {
+		t.Fatalf("expected a run from another ref to be refused, got %v", err)
+	}
+
+	last, err := detachSession(manifestPath, self.PID)
+	if err != nil || last != nil {
+		t.Fatalf("expected other participant to keep staging, got %v, %v", last, err)
+	}
+	onDisk, err := readManifest(manifestPath)
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if hasParticipant(onDisk.Participants, self.PID) {
+		t.Fatalf("expected self to be removed from participants")
+	}
+
+	last, err = detachSession(manifestPath, os.Getppid())
+	if err != nil || last == nil {
+		t.Fatalf("expected last participant to own cleanup, got %v, %v", last, err)
+	}
+}
+
+func TestConcurrentRunsShareStaging(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh and interrupts processes")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	staged := filepath.Join(dir, "example.txt")
+
+	first, firstOut := startConfik(t, dir)
+	waitForPath(t, staged)
+
+	start := time.Now()
+	code, stdout, stderr := runConfik(t, dir, "sh", "-c", "test -f example.txt")
+	if code != 0 {
+		t.Fatalf("expected attached run to see staged file, got %d (stderr: %s)", code, stderr)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Fatalf("attached run waited for the first run")
+	}
+	if !bytes.Contains([]byte(stdout), []byte("attached to active run")) {
+		t.Fatalf("expected attach message, got: %s", stdout)
+	}
+	if !exists(staged) {
+		t.Fatalf("expected staging to remain while the first run is active")
+	}
+	if code, _, _ := runConfik(t, dir, "--clean"); code == 0 || !exists(staged) {
+		t.Fatalf("expected --clean to refuse while a run is active")
+	}
+
+	second, _ := startConfik(t, dir, "sh", "-c", "touch second.started; sleep 1; test -f example.txt")
+	waitForPath(t, filepath.Join(dir, "second.started"))
+
+	if err := first.Process.Signal(os.Interrupt); err != nil {
+		t.Fatalf("interrupt first run: %v", err)
+	}
+	_ = first.Wait()
+	if !exists(staged) {
+		t.Fatalf("expected staging to survive while the second run is attached (output: %s)", firstOut)
+	}
+
+	if err := second.Wait(); err != nil {
+		t.Fatalf("expected second run to succeed: %v", err)
+	}
+	if exists(staged) {
+		t.Fatalf("expected last participant to clean up")
+	}
+	if exists(filepath.Join(configDir, manifestFilename)) {
+		t.Fatalf("expected manifest to be removed")
+	}
+}
+
+func TestCrashedParticipantDoesNotLeakStaging(t *testing.T) {
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	leftover := filepath.Join(dir, "leftover.txt")
+	if err := os.WriteFile(leftover, []byte("stale"), 0o644); err != nil {
+		t.Fatalf("write leftover: %v", err)
+	}
+	manifest := Manifest{
+		RunID:        "crashed",
+		CreatedFiles: []string{"leftover.txt"},
+		Participants: []Participant{{PID: deadPID(t)}},
+	}
+	if err := writeManifest(filepath.Join(configDir, manifestFilename), manifest); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+
+	code, stdout, stderr := runConfik(t, dir, testCommandArgs(0)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if bytes.Contains([]byte(stdout), []byte("attached")) {
+		t.Fatalf("did not expect to attach to a crashed run")
+	}
+	if exists(leftover) || exists(filepath.Join(dir, "example.txt")) {
+		t.Fatalf("expected stale and fresh staging to be cleaned up")
+	}
+}
+
+func TestAttachedRunStagesFilesItsCommandNeeds(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh and interrupts processes")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	cfg := `{"commands":{"sleep":{"include":["a.txt"]},"sh":{"include":["b.txt"]}}}`
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	for _, file := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(configDir, file), []byte(file), 0o644); err != nil {
+			t.Fatalf("write %s: %v", file, err)
+		}
+	}
+
+	first, firstOut := startConfik(t, dir, "sleep", "30")
+	waitForPath(t, filepath.Join(dir, "a.txt"))
+	if exists(filepath.Join(dir, "b.txt")) {
+		t.Fatalf("expected the first run to stage only a.txt")
+	}
+
+	code, stdout, stderr := runConfik(t, dir, "sh", "-c", "test -f a.txt && test -f b.txt")
+	if code != 0 {
+		t.Fatalf("expected the attached run to see both files, got %d (stderr: %s)", code, stderr)
+	}
+	if !bytes.Contains([]byte(stdout), []byte("staged 1 more file(s) for this command")) {
+		t.Fatalf("expected the attached run to top up the staging, got: %s", stdout)
+	}
+	if !exists(filepath.Join(dir, "a.txt")) || !exists(filepath.Join(dir, "b.txt")) {
+		t.Fatalf("expected the staging to stay while the first run is active")
+	}
+
+	if err := first.Process.Signal(os.Interrupt); err != nil {
+		t.Fatalf("interrupt first run: %v", err)
+	}
+	_ = first.Wait()
+	if exists(filepath.Join(dir, "a.txt")) || exists(filepath.Join(dir, "b.txt")) {
+		t.Fatalf("expected the last participant to clean up both files (output: %s)", firstOut)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// SessionRecord is one entry in the per-user session index. Every staging run
+// (including attached participants) registers itself so that sessions left
+// behind by crashed processes can be found across projects.
+type SessionRecord struct {
+	ProjectDir   string `json:"projectDir"`
+	ManifestPath string `json:"manifestPath"`
+	LockPath     string `json:"lockPath"`
+	LockBackend  string `json:"lockBackend,omitempty"`
+	RunID        string `json:"runId"`
+	PID          int    `json:"pid"`
+	StartID      string `json:"startId,omitempty"`
+	Command      string `json:"command,omitempty"`
+	StartedAt    string `json:"startedAt"`
+
+	path string
+}
+
+func (r SessionRecord) active() bool {
+	return processRunning(r.PID, r.StartID)
+}
+
+func sessionIndexDir() (string, error) {
+	stateHome, err := userStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateHome, "sessions"), nil
+}
+
+func newSessionRecord(cwd string, state StatePaths, lockBackend, runID string, self Participant) SessionRecord {
+	return SessionRecord{
+		ProjectDir:   cwd,
+		ManifestPath: state.ManifestPath,
+		LockPath:     state.LockPath,
+		LockBackend:  lockBackend,
+		RunID:        runID,
+		PID:          self.PID,
+		StartID:      self.StartID,
+		Command:      self.Command,
+		StartedAt:    self.StartedAt,
+	}
+}
+
+// registerSession writes record into the index and returns its path. Each
+// session gets its own file so concurrent runs never contend on the index.
+func registerSession(record SessionRecord) (string, error) {
+	dir, err := sessionIndexDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	pathname := filepath.Join(dir, fmt.Sprintf("%s-%d.json", record.RunID, record.PID))
+	return pathname, os.WriteFile(pathname, append(data, '\n'), 0o600)
+}
+
+// withSessionRecord registers the session, starts its watchdog and wraps
+// cleanup so the record is dropped once cleanup succeeds. Failed cleanups keep
+// the record for the watchdog and `confik gc`.
+func withSessionRecord(record SessionRecord, cleanup func() error) func() error {
+	recordPath, err := registerSession(record)
+	if err != nil {
+		return cleanup
+	}
+	watchdog, err := startWatchdog(recordPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "confik: watchdog unavailable (%v); use `confik gc` if this run is killed\n", err)
+	}
+	return func() error {
+		err := cleanup()
+		if err == nil {
+			_ = os.Remove(recordPath)
+		}
+		if watchdog != nil {
+			_ = watchdog.Close()
+		}
+		return err
+	}
+}
+
+func readSessionRecord(pathname string) (SessionRecord, error) {
+	// #nosec G304 -- pathname is inside the per-user session index.
+	data, err := os.ReadFile(pathname)
+	if err != nil {
+		return SessionRecord{}, err
+	}
+	var record SessionRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return SessionRecord{}, err
+	}
+	record.path = pathname
+	return record, nil
+}
+
+func listSessions() ([]SessionRecord, error) {
+	dir, err := sessionIndexDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	records := []SessionRecord{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		pathname := filepath.Join(dir, entry.Name())
+		record, err := readSessionRecord(pathname)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				fmt.Fprintf(os.Stderr, "confik: ignoring unreadable session record %s (%v)\n", pathname, err)
+			}
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].StartedAt < records[j].StartedAt })
+	return records, nil
+}
+
+func runPsCommand(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: confik ps")
+	}
+	records, err := listSessions()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		_, _ = fmt.Fprintln(os.Stdout, "confik: no sessions")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "STATUS\tPID\tSTARTED\tPROJECT\tCOMMAND")
+	for _, record := range records {
+		status := "active"
+		if !record.active() {
+			status = "orphaned"
+		}
+		command := record.Command
+		if command == "" {
+			command = "(standalone)"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", status, record.PID, record.StartedAt, record.ProjectDir, command)
+	}
+	return w.Flush()
+}
+
+func runGcCommand(args []string) error {
+	dryRun := false
+	for _, arg := range args {
+		if arg != "--dry-run" {
+			return errors.New("usage: confik gc [--dry-run]")
+		}
+		dryRun = true
+	}
+
+	records, err := listSessions()
+	if err != nil {
+		return err
+	}
+
+	collected := 0
+	var gcErr error
+	for _, record := range records {
+		if record.active() {
+			continue
+		}
+		if dryRun {
+			_, _ = fmt.Fprintf(os.Stdout, "confik: would clean orphaned session %s in %s\n", record.RunID, record.ProjectDir)
+			collected++
+			continue
+		}
+		if err := collectSession(record); err != nil {
+			gcErr = combineErrors(gcErr, fmt.Errorf("%s: %v", record.ProjectDir, err))
+			continue
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "confik: cleaned orphaned session %s in %s\n", record.RunID, record.ProjectDir)
+		collected++
+	}
+
+	if collected == 0 && gcErr == nil {
+		_, _ = fmt.Fprintln(os.Stdout, "confik: no orphaned sessions")
+	}
+	return gcErr
+}
+
+// collectSession cleans up after an orphaned session using the project's own
+// lock and manifest. Staging that other live participants still use is left
+// alone; only the orphaned record is dropped.
+func collectSession(record SessionRecord) error {
+	if isDirectory(record.ProjectDir) && exists(record.ManifestPath) {
+		lock, err := acquireLock(record.LockPath, LockOptions{Backend: record.LockBackend, Timeout: 10 * time.Second})
+		if err != nil {
+			return err
+		}
+		manifest, err := readManifest(record.ManifestPath)
+		if err == nil && len(liveParticipants(manifest.Participants)) > 0 {
+			err = lock.Unlock()
+		} else {
+			err = combineErrors(cleanLeftovers(record.ProjectDir, record.ManifestPath, false, true), lock.Unlock())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(record.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSessionRecordLifecycle(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	self := newParticipant("vite", nil)
+	record := newSessionRecord("/project", newStatePaths("/project/.config"), lockBackendAuto, "run1", self)
+	cleaned := false
+	cleanup := withSessionRecord(record, func() error {
+		cleaned = true
+		return nil
+	})
+
+	records, err := listSessions()
+	if err != nil {
+		t.Fatalf("listSessions error: %v", err)
+	}
+	if len(records) != 1 || records[0].RunID != "run1" || !records[0].active() {
+		t.Fatalf("expected one active record, got %#v", records)
+	}
+
+	if err := cleanup(); err != nil || !cleaned {
+		t.Fatalf("expected cleanup to run, got %v", err)
+	}
+	records, err = listSessions()
+	if err != nil {
+		t.Fatalf("listSessions error: %v", err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("expected record to be removed after cleanup, got %#v", records)
+	}
+}
+
+func TestPsAndGcCommands(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	project := t.TempDir()
+	configDir := filepath.Join(project, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	leftover := filepath.Join(project, "leftover.txt")
+	if err := os.WriteFile(leftover, []byte("stale"), 0o644); err != nil {
+		t.Fatalf("write leftover: %v", err)
+	}
+	crashed := Participant{PID: deadPID(t), StartedAt: "2024-01-01T00:00:00Z", Command: "vite"}
+	manifest := Manifest{RunID: "crashed", CreatedFiles: []string{"leftover.txt"}, Participants: []Participant{crashed}}
+	state := newStatePaths(configDir)
+	if err := writeManifest(state.ManifestPath, manifest); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	if _, err := registerSession(newSessionRecord(project, state, lockBackendAuto, "crashed", crashed)); err != nil {
+		t.Fatalf("registerSession error: %v", err)
+	}
+	live := newParticipant("vitest --watch", nil)
+	if _, err := registerSession(newSessionRecord(t.TempDir(), state, lockBackendAuto, "live", live)); err != nil {
+		t.Fatalf("registerSession error: %v", err)
+	}
+
+	code, stdout, stderr := runConfik(t, project, "ps")
+	if code != 0 {
+		t.Fatalf("expected ps to succeed, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "orphaned") || !strings.Contains(stdout, "active") || !strings.Contains(stdout, project) {
+		t.Fatalf("unexpected ps output:\n%s", stdout)
+	}
+
+	code, stdout, _ = runConfik(t, project, "gc", "--dry-run")
+	if code != 0 || !strings.Contains(stdout, "would clean orphaned session crashed") || !exists(leftover) {
+		t.Fatalf("expected dry-run gc to only report, got %d:\n%s", code, stdout)
+	}
+
+	code, stdout, stderr = runConfik(t, project, "gc")
+	if code != 0 {
+		t.Fatalf("expected gc to succeed, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "cleaned orphaned session crashed") {
+		t.Fatalf("unexpected gc output:\n%s", stdout)
+	}
+	if exists(leftover) || exists(state.ManifestPath) {
+		t.Fatalf("expected orphaned staging to be cleaned up")
+	}
+
+	records, err := listSessions()
+	if err != nil {
+		t.Fatalf("listSessions error: %v", err)
+	}
+	if len(records) != 1 || records[0].RunID != "live" {
+		t.Fatalf("expected only the active record to remain, got %#v", records)
+	}
+}
+
+func TestRunRemovesSessionRecord(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	code, _, stderr := runConfik(t, dir, testCommandArgs(0)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	records, err := listSessions()
+	if err != nil {
+		t.Fatalf("listSessions error: %v", err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("expected session record to be removed after a clean exit, got %#v", records)
+	}
+}
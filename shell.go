@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strings"
+)
+
+// shellCommand runs line through the user's shell: $SHELL -c on Unix (or
+// /bin/sh when unset) and %ComSpec% /C on Windows.
+func shellCommand(line string) (string, []string) {
+	if runtime.GOOS == "windows" {
+		shell := os.Getenv("ComSpec")
+		if shell == "" {
+			shell = "cmd"
+		}
+		return shell, []string{"/C", line}
+	}
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	return shell, []string{"-c", line}
+}
+
+// shellQuote quotes arg so that the shell passes it on as a single word.
+func shellQuote(arg string) string {
+	if runtime.GOOS == "windows" {
+		return cmdQuote(arg)
+	}
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:@%+,") == "" {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// cmdQuote quotes arg for a %ComSpec% /C line. An embedded quote is doubled,
+// which keeps cmd.exe inside the quoted word, so that & or | in arg are not
+// taken as operators, and which the program's C runtime reads back as one
+// quote. Backslashes are only doubled where they precede a quote. cmd.exe
+// still expands %VAR% inside quotes.
+func cmdQuote(arg string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	slashes := 0
+	for _, r := range arg {
+		switch r {
+		case '\\':
+			slashes++
+		case '"':
+			b.WriteString(strings.Repeat(`\`, slashes))
+			b.WriteString(`""`)
+			slashes = 0
+			continue
+		default:
+			slashes = 0
+		}
+		b.WriteRune(r)
+	}
+	b.WriteString(strings.Repeat(`\`, slashes))
+	b.WriteByte('"')
+	return b.String()
+}
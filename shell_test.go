@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+func TestShellCommandUsesShellVariable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses $SHELL")
+	}
+	t.Setenv("SHELL", "/bin/bash")
+	if shell, args := shellCommand("echo hi"); shell != "/bin/bash" || len(args) != 2 || args[0] != "-c" || args[1] != "echo hi" {
+		t.Fatalf("unexpected shell command: %s %v", shell, args)
+	}
+	t.Setenv("SHELL", "")
+	if shell, _ := shellCommand("echo hi"); shell != "/bin/sh" {
+		t.Fatalf("expected /bin/sh without $SHELL, got %s", shell)
+	}
+}
+
+func TestShellQuoteRoundTrips(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	for _, arg := range []string{"plain", "--flag=value", "", "two words", "it's", `a"b`, "$HOME", "*.ts"} {
+		out, err := exec.Command("/bin/sh", "-c", "printf %s "+shellQuote(arg)).Output()
+		if err != nil {
+			t.Fatalf("sh for %q: %v", arg, err)
+		}
+		if string(out) != arg {
+			t.Fatalf("shellQuote(%q) came back as %q", arg, out)
+		}
+	}
+	if got := shellQuote("src/index.ts"); got != "src/index.ts" {
+		t.Fatalf("expected safe argument to stay unquoted, got %s", got)
+	}
+}
+
+func TestCmdQuote(t *testing.T) {
+	cases := map[string]string{
+		"plain":      `"plain"`,
+		"":           `""`,
+		"two words":  `"two words"`,
+		`a"b`:        `"a""b"`,
+		"a & b":      `"a & b"`,
+		`C:\dir\`:    `"C:\dir\\"`,
+		`say \"hi\"`: `"say \\""hi\\"""`,
+	}
+	for arg, want := range cases {
+		if got := cmdQuote(arg); got != want {
+			t.Fatalf("cmdQuote(%q) = %s, want %s", arg, got, want)
+		}
+	}
+}
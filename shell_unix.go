@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "os/exec"
+
+// passShellLine has nothing to do outside Windows: the shell gets its line as
+// a single argument.
+func passShellLine(cmd *exec.Cmd) {}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// passShellLine hands a %ComSpec% /C line to cmd.exe as written. Go would
+// escape it by the C runtime's rules, which cmd.exe does not follow; /S makes
+// cmd.exe strip just the outer quotes added here.
+func passShellLine(cmd *exec.Cmd) {
+	shell, _ := shellCommand("")
+	if len(cmd.Args) != 3 || cmd.Args[0] != shell || cmd.Args[1] != "/C" {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CmdLine = syscall.EscapeArg(shell) + ` /S /C "` + cmd.Args[2] + `"`
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configEntry is a file that may be staged from .config/, either from the
+// working tree (Path) or from a git revision (Blob).
+type configEntry struct {
+	Rel  string
+	Path string
+	Blob string
+	Mode os.FileMode
+}
+
+func listWorkingTreeEntries(configDir string) []configEntry {
+	entries := []configEntry{}
+	_ = filepath.WalkDir(configDir, func(pathname string, d fs.DirEntry, entryErr error) error {
+		if entryErr != nil {
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(configDir, pathname)
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, configEntry{Rel: filepath.ToSlash(rel), Path: pathname})
+		return nil
+	})
+	return entries
+}
+
+func resolveRevision(cwd, rev string) (string, error) {
+	// #nosec G204 -- rev is passed as a single argument after --verify and never interpreted by a shell.
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", "--end-of-options", rev+"^{commit}")
+	cmd.Dir = cwd
+	out, err := outputOwnChild(cmd)
+	if err != nil {
+		return "", fmt.Errorf("unknown git revision %q", rev)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// listRevisionEntries lists regular files below .config/ (relative to cwd) at commit.
+// Symlinks and submodules are skipped because their targets are not part of the tree.
+func listRevisionEntries(cwd, commit string) ([]configEntry, error) {
+	// #nosec G204 -- commit is a resolved object id.
+	cmd := exec.Command("git", "ls-tree", "-r", "-z", commit+":./.config")
+	cmd.Dir = cwd
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := outputOwnChild(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("no .config directory at %s (%s)", shortCommit(commit), strings.TrimSpace(stderr.String()))
+	}
+
+	entries := []configEntry{}
+	for _, record := range strings.Split(string(out), "\x00") {
+		if record == "" {
+			continue
+		}
+		meta, name, ok := strings.Cut(record, "\t")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(meta)
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		mode, err := strconv.ParseUint(fields[0], 8, 32)
+		if err != nil || mode&0o170000 != 0o100000 {
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "confik: skipping %s from %s (not a regular file)\n", name, shortCommit(commit))
+			}
+			continue
+		}
+		entries = append(entries, configEntry{Rel: name, Blob: fields[2], Mode: os.FileMode(mode & 0o777)})
+	}
+	return entries, nil
+}
+
+func readRevisionFile(cwd, commit, rel string) ([]byte, bool) {
+	// #nosec G204 -- commit is a resolved object id and rel is a fixed filename.
+	cmd := exec.Command("git", "cat-file", "blob", commit+":./.config/"+rel)
+	cmd.Dir = cwd
+	out, err := outputOwnChild(cmd)
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+// gitIgnoredEntries returns the working tree entries that the repository's
+// ignore rules (.gitignore files, .git/info/exclude and core.excludesFile)
+// leave out, keyed by Rel. As in git, tracked files are never ignored.
+// Outside a git repository nothing is.
+func gitIgnoredEntries(cwd string, entries []configEntry) (map[string]bool, error) {
+	ignored := map[string]bool{}
+	if len(entries) == 0 || findGitRoot(cwd) == "" {
+		return ignored, nil
+	}
+	rels := map[string]string{}
+	var input bytes.Buffer
+	for _, entry := range entries {
+		rels[entry.Path] = entry.Rel
+		input.WriteString(entry.Path)
+		input.WriteByte(0)
+	}
+	cmd := exec.Command("git", "check-ignore", "-z", "--stdin")
+	cmd.Dir = cwd
+	cmd.Stdin = &input
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := outputOwnChild(cmd)
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		// Exit code 1 only means that no path is ignored.
+		return nil, fmt.Errorf("git check-ignore failed (%s)", strings.TrimSpace(stderr.String()))
+	}
+	for _, pathname := range strings.Split(string(out), "\x00") {
+		if rel, ok := rels[pathname]; ok {
+			ignored[rel] = true
+		}
+	}
+	return ignored, nil
+}
+
+func copyEntry(cwd string, entry configEntry, dest string) error {
+	if entry.Blob == "" {
+		return copyFile(entry.Path, dest)
+	}
+
+	// #nosec G304 -- dest is derived from cwd + relative .config path.
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	// #nosec G204 -- entry.Blob is an object id from git ls-tree.
+	cmd := exec.Command("git", "cat-file", "blob", entry.Blob)
+	cmd.Dir = cwd
+	cmd.Stdout = out
+	if err := runOwnChild(cmd); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dest)
+		return fmt.Errorf("failed to read %s from git (%v)", entry.Rel, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dest, entry.Mode)
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestListWorkingTreeEntries(t *testing.T) {
+	configDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(configDir, "nested"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for _, rel := range []string{"a.txt", filepath.Join("nested", "b.txt")} {
+		if err := os.WriteFile(filepath.Join(configDir, rel), []byte("x"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+
+	entries := listWorkingTreeEntries(configDir)
+	if len(entries) != 2 || entries[0].Rel != "a.txt" || entries[1].Rel != "nested/b.txt" {
+		t.Fatalf("unexpected entries: %#v", entries)
+	}
+}
+
+func TestFromRefStagesRevisionContents(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh to observe staged files")
+	}
+
+	dir := t.TempDir()
+	initGitRepo(t, dir)
+
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "app.config.js"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(`{"exclude":["skip.txt"]}`), 0o644); err != nil {
+		t.Fatalf("write confik.json: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "skip.txt"), []byte("skip"), 0o644); err != nil {
+		t.Fatalf("write skip: %v", err)
+	}
+	runGit(t, dir, "add", ".config")
+	runGit(t, dir, "commit", "-q", "-m", "old config")
+	runGit(t, dir, "tag", "old")
+
+	if err := os.WriteFile(filepath.Join(configDir, "app.config.js"), []byte("new"), 0o644); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "untracked.txt"), []byte("wip"), 0o644); err != nil {
+		t.Fatalf("write untracked: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(`{}`), 0o644); err != nil {
+		t.Fatalf("rewrite confik.json: %v", err)
+	}
+
+	script := "cat app.config.js > observed.txt; ls > listing.txt; cp .config/" + manifestFilename + " manifest.copy"
+	code, _, stderr := runConfik(t, dir, "--from-ref", "old", "sh", "-c", script)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+
+	observed, err := os.ReadFile(filepath.Join(dir, "observed.txt"))
+	if err != nil {
+		t.Fatalf("read observed: %v", err)
+	}
+	if string(observed) != "old" {
+		t.Fatalf("expected staged content from revision, got %q", observed)
+	}
+	listing, err := os.ReadFile(filepath.Join(dir, "listing.txt"))
+	if err != nil {
+		t.Fatalf("read listing: %v", err)
+	}
+	if strings.Contains(string(listing), "untracked.txt") {
+		t.Fatalf("did not expect working-tree-only file to be staged")
+	}
+	if strings.Contains(string(listing), "skip.txt") {
+		t.Fatalf("expected exclude from revision confik.json to apply")
+	}
+
+	manifest, err := readManifest(filepath.Join(dir, "manifest.copy"))
+	if err != nil {
+		t.Fatalf("read manifest copy: %v", err)
+	}
+	if manifest.SourceRef != "old" || len(manifest.SourceCommit) != 40 {
+		t.Fatalf("expected manifest to record ref, got %q / %q", manifest.SourceRef, manifest.SourceCommit)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "app.config.js")); err == nil {
+		t.Fatalf("expected staged file to be removed")
+	}
+}
+
+func TestFromRefUnknownRevisionFails(t *testing.T) {
+	dir := t.TempDir()
+	initGitRepo(t, dir)
+	if err := os.MkdirAll(filepath.Join(dir, ".config"), 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+
+	code, _, _ := runConfik(t, dir, "--from-ref", "does-not-exist", "--dry-run")
+	if code == 0 {
+		t.Fatalf("expected unknown revision to fail")
+	}
+}
+
+func TestFromRefDoesNotAttachToOtherSource(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("interrupts processes")
+	}
+
+	dir := t.TempDir()
+	initGitRepo(t, dir)
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "app.config.js"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	runGit(t, dir, "add", ".config")
+	runGit(t, dir, "commit", "-q", "-m", "old config")
+	if err := os.WriteFile(filepath.Join(configDir, "app.config.js"), []byte("new"), 0o644); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+
+	first, firstOut := startConfik(t, dir)
+	waitForPath(t, filepath.Join(dir, "app.config.js"))
+	defer func() {
+		_ = first.Process.Signal(os.Interrupt)
+		_ = first.Wait()
+	}()
+
+	for _, args := range [][]string{
+		append([]string{"--from-ref", "HEAD"}, testCommandArgs(0)...),
+		append([]string{"--from-ref", "HEAD", "--dry-run"}, testCommandArgs(0)...),
+	} {
+		if code, stdout, _ := runConfik(t, dir, args...); code == 0 || strings.Contains(stdout, "attach") {
+			t.Fatalf("expected %v to refuse the working-tree staging, got %d (output: %s)", args, code, stdout)
+		}
+	}
+	manifest, err := readManifest(filepath.Join(configDir, manifestFilename))
+	if err != nil {
+		t.Fatalf("read manifest: %v (output: %s)", err, firstOut)
+	}
+	if len(manifest.Participants) != 1 {
+		t.Fatalf("expected the refused run not to join, got %#v", manifest.Participants)
+	}
+}
+
+func TestGitIgnoredEntries(t *testing.T) {
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	for _, rel := range []string{"a.txt", "env.local", "shared.local", "tracked.local"} {
+		if err := os.WriteFile(filepath.Join(configDir, rel), []byte("x"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+	entries := listWorkingTreeEntries(configDir)
+
+	ignored, err := gitIgnoredEntries(dir, entries)
+	if err != nil || len(ignored) != 0 {
+		t.Fatalf("expected nothing to be ignored outside a git repository: %v (%v)", ignored, err)
+	}
+
+	initGitRepo(t, dir)
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.local\n!shared.local\n"), 0o644); err != nil {
+		t.Fatalf("write .gitignore: %v", err)
+	}
+	cmd := exec.Command("git", "add", "-f", ".config/tracked.local")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git add: %v (%s)", err, out)
+	}
+
+	ignored, err = gitIgnoredEntries(dir, entries)
+	if err != nil {
+		t.Fatalf("gitIgnoredEntries: %v", err)
+	}
+	if len(ignored) != 1 || !ignored["env.local"] {
+		t.Fatalf("expected only env.local to be ignored, got %v", ignored)
+	}
+}
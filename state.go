@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// State locations for the lock file and manifest. config keeps them in
+// .config/ (falling back to xdg when .config/ is read-only), git puts them
+// under the resolved git dir and xdg under the per-user state directory.
+const (
+	stateLocationConfig = "config"
+	stateLocationGit    = "git"
+	stateLocationXDG    = "xdg"
+	envStateLocation    = "CONFIK_STATE"
+)
+
+// StatePaths is where confik keeps its bookkeeping for one project.
+type StatePaths struct {
+	Dir          string
+	ManifestPath string
+	LockPath     string
+}
+
+func newStatePaths(dir string) StatePaths {
+	return StatePaths{
+		Dir:          dir,
+		ManifestPath: filepath.Join(dir, manifestFilename),
+		LockPath:     filepath.Join(dir, lockFilename),
+	}
+}
+
+// resolveStateLocation picks the location from the environment, then confik.json.
+func resolveStateLocation(configured string) (string, error) {
+	location := os.Getenv(envStateLocation)
+	if location == "" {
+		location = configured
+	}
+	switch location {
+	case "":
+		return stateLocationConfig, nil
+	case stateLocationConfig, stateLocationGit, stateLocationXDG:
+		return location, nil
+	}
+	return "", fmt.Errorf("unknown state location %q (expected config, git or xdg)", location)
+}
+
+func resolveStatePaths(cwd, location string) (StatePaths, error) {
+	configDir := filepath.Join(cwd, ".config")
+	switch location {
+	case stateLocationGit:
+		gitRoot := findGitRoot(cwd)
+		if gitRoot == "" {
+			return StatePaths{}, errors.New("state location \"git\" requires a git repository")
+		}
+		gitDir, err := resolveGitDir(gitRoot)
+		if err != nil {
+			return StatePaths{}, err
+		}
+		return newStatePaths(filepath.Join(gitDir, "confik", projectStateKey(cwd))), nil
+	case stateLocationXDG:
+		stateHome, err := userStateDir()
+		if err != nil {
+			return StatePaths{}, err
+		}
+		return newStatePaths(filepath.Join(stateHome, projectStateKey(cwd))), nil
+	}
+	if !dirWritable(configDir) {
+		return resolveStatePaths(cwd, stateLocationXDG)
+	}
+	return newStatePaths(configDir), nil
+}
+
+// projectManifestPath returns the manifest location for a project directory,
+// honouring its confik.json. Errors fall back to .config/.
+func projectManifestPath(projectDir string) string {
+	configDir := filepath.Join(projectDir, ".config")
+	location, err := resolveStateLocation(loadConfig(configDir).StateLocation)
+	if err == nil {
+		if paths, err := resolveStatePaths(projectDir, location); err == nil {
+			return paths.ManifestPath
+		}
+	}
+	return filepath.Join(configDir, manifestFilename)
+}
+
+// projectStateKey names a project's state directory after its canonical path,
+// so the same project always maps to the same place.
+func projectStateKey(cwd string) string {
+	sum := sha256.Sum256([]byte(canonicalPath(cwd)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// userStateDir returns $XDG_STATE_HOME/confik (~/.local/state/confik by
+// default, %LOCALAPPDATA%\confik\state on Windows).
+func userStateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" && filepath.IsAbs(dir) {
+		return filepath.Join(dir, "confik"), nil
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, "confik", "state"), nil
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to locate state directory (%v)", err)
+	}
+	return filepath.Join(home, ".local", "state", "confik"), nil
+}
+
+// migrateLegacyState moves a manifest and lock file left in .config/ by an
+// earlier run into the configured state directory. The caller must hold the
+// lock for paths.
+func migrateLegacyState(configDir string, paths StatePaths) error {
+	legacy := newStatePaths(configDir)
+	if legacy.Dir == paths.Dir {
+		return nil
+	}
+
+	if exists(legacy.LockPath) {
+		// An older confik still holding the old lock owns the manifest too:
+		// moved away, it would look abandoned and its files would be cleaned
+		// up under its command. Leave both alone until that run exits.
+		lock, err := acquireLock(legacy.LockPath, LockOptions{Backend: lockBackendFlock, NoWait: true})
+		if err != nil {
+			return fmt.Errorf("left %s in place (%v)", legacy.ManifestPath, err)
+		}
+		defer func() {
+			_ = lock.Unlock()
+			_ = os.Remove(legacy.LockPath)
+		}()
+	}
+
+	if exists(legacy.ManifestPath) && !exists(paths.ManifestPath) {
+		if err := moveFile(legacy.ManifestPath, paths.ManifestPath); err != nil {
+			return fmt.Errorf("migrate %s (%v)", legacy.ManifestPath, err)
+		}
+	}
+	return nil
+}
+
+func moveFile(src, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	// #nosec G304 -- src is a confik state file in .config.
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	// #nosec G304 -- dest is a confik state file in the state dir.
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dest)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestResolveStateLocation(t *testing.T) {
+	t.Setenv(envStateLocation, "")
+	if got, err := resolveStateLocation(""); err != nil || got != stateLocationConfig {
+		t.Fatalf("expected config default, got %q, %v", got, err)
+	}
+	if got, err := resolveStateLocation(stateLocationGit); err != nil || got != stateLocationGit {
+		t.Fatalf("expected configured location, got %q, %v", got, err)
+	}
+	t.Setenv(envStateLocation, stateLocationXDG)
+	if got, err := resolveStateLocation(stateLocationGit); err != nil || got != stateLocationXDG {
+		t.Fatalf("expected environment to override config, got %q, %v", got, err)
+	}
+	t.Setenv(envStateLocation, "tmp")
+	if _, err := resolveStateLocation(""); err == nil {
+		t.Fatalf("expected error for unknown location")
+	}
+}
+
+func TestResolveStatePaths(t *testing.T) {
+	project := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(project, ".config"), 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+
+	paths, err := resolveStatePaths(project, stateLocationConfig)
+	if err != nil {
+		t.Fatalf("resolveStatePaths error: %v", err)
+	}
+	if paths.ManifestPath != filepath.Join(project, ".config", manifestFilename) {
+		t.Fatalf("unexpected config manifest path: %q", paths.ManifestPath)
+	}
+
+	if _, err := resolveStatePaths(project, stateLocationGit); err == nil {
+		t.Fatalf("expected git location to require a repository")
+	}
+	if err := os.MkdirAll(filepath.Join(project, ".git"), 0o755); err != nil {
+		t.Fatalf("mkdir .git: %v", err)
+	}
+	paths, err = resolveStatePaths(project, stateLocationGit)
+	if err != nil {
+		t.Fatalf("resolveStatePaths error: %v", err)
+	}
+	if want := filepath.Join(project, ".git", "confik", projectStateKey(project)); paths.Dir != want {
+		t.Fatalf("unexpected git state dir: got %q want %q", paths.Dir, want)
+	}
+
+	stateHome := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", stateHome)
+	paths, err = resolveStatePaths(project, stateLocationXDG)
+	if err != nil {
+		t.Fatalf("resolveStatePaths error: %v", err)
+	}
+	if want := filepath.Join(stateHome, "confik", projectStateKey(project)); paths.Dir != want {
+		t.Fatalf("unexpected xdg state dir: got %q want %q", paths.Dir, want)
+	}
+
+	if projectStateKey(project) == projectStateKey(t.TempDir()) {
+		t.Fatalf("expected distinct projects to get distinct state keys")
+	}
+}
+
+func TestGitStateLocationKeepsConfigClean(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh to observe state files")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(filepath.Join(dir, ".git"), 0o755); err != nil {
+		t.Fatalf("mkdir .git: %v", err)
+	}
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(`{"state":"git"}`), 0o644); err != nil {
+		t.Fatalf("write confik.json: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	stateDir := filepath.Join(dir, ".git", "confik", projectStateKey(dir))
+	script := "ls -a .config > config.listing; test -f '" + filepath.Join(stateDir, manifestFilename) + "'"
+	code, _, stderr := runConfik(t, dir, "sh", "-c", script)
+	if code != 0 {
+		t.Fatalf("expected manifest in git state dir, got %d (stderr: %s)", code, stderr)
+	}
+	listing, err := os.ReadFile(filepath.Join(dir, "config.listing"))
+	if err != nil {
+		t.Fatalf("read listing: %v", err)
+	}
+	if strings.Contains(string(listing), manifestFilename) || strings.Contains(string(listing), lockFilename) {
+		t.Fatalf("expected no confik state in .config, got:\n%s", listing)
+	}
+	if exists(filepath.Join(stateDir, manifestFilename)) || exists(filepath.Join(dir, "example.txt")) {
+		t.Fatalf("expected staging and manifest to be cleaned up")
+	}
+}
+
+func TestLegacyStateIsMigrated(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv(envStateLocation, stateLocationXDG)
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	leftover := filepath.Join(dir, "leftover.txt")
+	if err := os.WriteFile(leftover, []byte("stale"), 0o644); err != nil {
+		t.Fatalf("write leftover: %v", err)
+	}
+	manifest := Manifest{RunID: "old", CreatedFiles: []string{"leftover.txt"}}
+	if err := writeManifest(filepath.Join(configDir, manifestFilename), manifest); err != nil {
+		t.Fatalf("write legacy manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, lockFilename), []byte("pid=1\n"), 0o600); err != nil {
+		t.Fatalf("write legacy lock: %v", err)
+	}
+
+	code, _, stderr := runConfik(t, dir, "--clean")
+	if code != 0 {
+		t.Fatalf("expected clean to succeed, got %d (stderr: %s)", code, stderr)
+	}
+	if exists(leftover) {
+		t.Fatalf("expected migrated manifest to drive cleanup")
+	}
+	if exists(filepath.Join(configDir, manifestFilename)) || exists(filepath.Join(configDir, lockFilename)) {
+		t.Fatalf("expected legacy state to be removed from .config")
+	}
+}
+
+func TestLegacyStateHeldByOlderRunIsLeftAlone(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv(envStateLocation, stateLocationXDG)
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	staged := filepath.Join(dir, "staged.txt")
+	if err := os.WriteFile(staged, []byte("in use"), 0o644); err != nil {
+		t.Fatalf("write staged: %v", err)
+	}
+	legacyManifest := filepath.Join(configDir, manifestFilename)
+	manifest := Manifest{RunID: "older", CreatedFiles: []string{"staged.txt"}}
+	if err := writeManifest(legacyManifest, manifest); err != nil {
+		t.Fatalf("write legacy manifest: %v", err)
+	}
+	// An older confik, still running, holds the lock in .config.
+	held, err := acquireLock(filepath.Join(configDir, lockFilename), LockOptions{Backend: lockBackendFlock, NoWait: true})
+	if err != nil {
+		t.Fatalf("acquire legacy lock: %v", err)
+	}
+	defer func() { _ = held.Unlock() }()
+
+	code, _, stderr := runConfik(t, dir, "--clean")
+	if code != 0 {
+		t.Fatalf("expected clean to succeed, got %d (stderr: %s)", code, stderr)
+	}
+	if !exists(staged) || !exists(legacyManifest) {
+		t.Fatalf("expected the older run's staging to be left alone (stderr: %s)", stderr)
+	}
+}
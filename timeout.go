@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// timeoutExitCode matches timeout(1), so CI logs read the same either way.
+const timeoutExitCode = 124
+
+// timeoutGracePeriod is how long a timed-out command gets to exit after
+// SIGTERM before it is killed.
+const timeoutGracePeriod = 10 * time.Second
+
+// commandTimeout stops a command that runs for too long: SIGTERM to its
+// process group first, SIGKILL once the grace period is over.
+type commandTimeout struct {
+	mu       sync.Mutex
+	timer    *time.Timer
+	expired  bool
+	finished bool
+}
+
+func startCommandTimeout(command string, timeout time.Duration, group *processGroup) *commandTimeout {
+	t := &commandTimeout{}
+	if timeout <= 0 {
+		return t
+	}
+	t.timer = time.AfterFunc(timeout, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.finished {
+			return
+		}
+		t.expired = true
+		fmt.Fprintf(os.Stderr, "confik: %s timed out after %s, sending SIGTERM\n", command, timeout)
+		group.stop(syscall.SIGTERM)
+		t.timer = time.AfterFunc(timeoutGracePeriod, func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.finished {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "confik: %s still running %s after SIGTERM, killing it\n", command, timeoutGracePeriod)
+			group.signal(syscall.SIGKILL)
+		})
+	})
+	return t
+}
+
+// stop disarms the timeout once the command has exited and reports whether it
+// had expired.
+func (t *commandTimeout) stop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finished = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	return t.expired
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutStopsCommandAndCleansUp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	script := `trap 'touch got-term; exit 0' TERM
+sleep 30 &
+wait`
+	start := time.Now()
+	code, _, stderr := runConfik(t, dir, "--timeout", "300ms", "sh", "-c", script)
+	if code != timeoutExitCode {
+		t.Fatalf("expected timeout exit code %d, got %d (stderr: %s)", timeoutExitCode, code, stderr)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("expected the background sleep to be stopped with the process group")
+	}
+	if !strings.Contains(stderr, "timed out after 300ms") {
+		t.Fatalf("expected timeout message, got: %s", stderr)
+	}
+	if !exists(filepath.Join(dir, "got-term")) {
+		t.Fatalf("expected command to receive SIGTERM first")
+	}
+	if exists(filepath.Join(dir, "example.txt")) {
+		t.Fatalf("expected staged file to be cleaned up")
+	}
+}
+
+func TestTimeoutNotTriggeredForFastCommand(t *testing.T) {
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(`{"timeout":"1m"}`), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	code, _, stderr := runConfik(t, dir, testCommandArgs(3)...)
+	if code != 3 {
+		t.Fatalf("expected the command's exit code 3, got %d (stderr: %s)", code, stderr)
+	}
+}
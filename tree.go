@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// treeGracePeriod is how long --wait-tree waits for background processes
+// after the command exits before killing them.
+const treeGracePeriod = 10 * time.Second
+
+// processTree tracks the wrapped command and everything it spawns in
+// --wait-tree mode. The command runs in its own process group with pgid equal
+// to its pid.
+type processTree struct {
+	grace time.Duration
+	pgid  int
+}
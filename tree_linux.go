@@ -0,0 +1,121 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// newProcessTree makes confik a child subreaper so that descendants orphaned
+// by the command are reparented to confik instead of init and can be waited for.
+func newProcessTree(grace time.Duration) (*processTree, error) {
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return nil, fmt.Errorf("failed to become a child subreaper (%v)", err)
+	}
+	return &processTree{grace: grace}, nil
+}
+
+func (t *processTree) prepare(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func (t *processTree) started(pid int) {
+	t.pgid = pid
+}
+
+// wait reaps every remaining child of confik after the command has exited.
+// Processes still running after the grace period are killed along with the
+// command's process group.
+func (t *processTree) wait() {
+	deadline := time.Now().Add(t.grace)
+	announced := false
+	var killedAt time.Time
+	for {
+		children := reapChildren()
+		if len(children) == 0 {
+			return
+		}
+		if !announced {
+			fmt.Fprintf(os.Stderr, "confik: waiting for %d background process(es) to exit\n", len(children))
+			announced = true
+		}
+		switch {
+		case killedAt.IsZero() && time.Now().After(deadline):
+			fmt.Fprintf(os.Stderr, "confik: background processes still running after %s, killing them\n", t.grace)
+			if t.pgid > 0 {
+				_ = syscall.Kill(-t.pgid, syscall.SIGKILL)
+			}
+			for _, pid := range children {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+			killedAt = time.Now()
+		case !killedAt.IsZero() && time.Since(killedAt) > 5*time.Second:
+			fmt.Fprintf(os.Stderr, "confik: giving up on %d unkillable process(es)\n", len(children))
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// reapChildren collects exited children and returns the ones still running.
+// confik's own children, such as the watchdog, are not counted: they are not
+// part of the command's tree, whatever session they run in.
+func reapChildren() []int {
+	ownChildren.Lock()
+	defer ownChildren.Unlock()
+	self := os.Getpid()
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	running := []int{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		ppid, ok := readProcParent(pid)
+		if !ok || ppid != self || ownChildren.pids[pid] {
+			continue
+		}
+		var status unix.WaitStatus
+		if reaped, err := unix.Wait4(pid, &status, unix.WNOHANG, nil); err == nil && reaped == pid {
+			continue
+		}
+		running = append(running, pid)
+	}
+	return running
+}
+
+func readProcParent(pid int) (int, bool) {
+	// #nosec G304 -- path is built from a numeric pid.
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, false
+	}
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0, false
+	}
+	// Fields after the command name: state, ppid.
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 2 {
+		return 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, false
+	}
+	return ppid, true
+}
@@ -0,0 +1,98 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestProcessTreeKillsAfterGrace runs in a child process because becoming a
+// subreaper would make the test binary inherit orphans from other tests.
+func TestProcessTreeKillsAfterGrace(t *testing.T) {
+	if os.Getenv("CONFIK_TREE_TEST") != "1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestProcessTreeKillsAfterGrace$", "-test.v")
+		cmd.Env = append(os.Environ(), "CONFIK_TREE_TEST=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("tree test failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	tree, err := newProcessTree(200 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("newProcessTree error: %v", err)
+	}
+	start := time.Now()
+	code, err := runCommand("sh", []string{"-c", "sleep 30 >/dev/null 2>&1 & exit 3"}, commandOptions{Tree: tree})
+	if err != nil || code != 3 {
+		t.Fatalf("runCommand = %d, %v", code, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected background process to be killed after the grace period, took %s", elapsed)
+	}
+	if children := reapChildren(); len(children) != 0 {
+		t.Fatalf("expected all children to be reaped, got %v", children)
+	}
+}
+
+// TestReapChildrenLeavesOwnChildren runs in a child process so that reaping
+// cannot take exit statuses away from other tests.
+func TestReapChildrenLeavesOwnChildren(t *testing.T) {
+	if os.Getenv("CONFIK_TREE_TEST") != "1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestReapChildrenLeavesOwnChildren$", "-test.v")
+		cmd.Env = append(os.Environ(), "CONFIK_TREE_TEST=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("reap test failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	own := exec.Command("sh", "-c", "exit 3")
+	if err := startOwnChild(own); err != nil {
+		t.Fatalf("startOwnChild error: %v", err)
+	}
+	orphan := exec.Command("sh", "-c", "exit 0")
+	if err := orphan.Start(); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(reapChildren()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := orphan.Wait(); err == nil {
+		t.Fatalf("expected the other child to have been reaped")
+	}
+	err := own.Wait()
+	forgetOwnChild(own.Process.Pid)
+	if own.ProcessState == nil || own.ProcessState.ExitCode() != 3 {
+		t.Fatalf("expected the own child's exit status to be kept, got %v", err)
+	}
+}
+
+// TestRunCommandForgetsReleasedChild runs in a child process because --init
+// reaps every orphan of the test binary.
+func TestRunCommandForgetsReleasedChild(t *testing.T) {
+	if os.Getenv("CONFIK_TREE_TEST") != "1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestRunCommandForgetsReleasedChild$", "-test.v")
+		cmd.Env = append(os.Environ(), "CONFIK_TREE_TEST=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("forget test failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	// waitAsInit releases the command's process, which resets its Pid.
+	for i := 0; i < 3; i++ {
+		if code, err := runCommand("sh", []string{"-c", "exit 2"}, commandOptions{Init: true}); err != nil || code != 2 {
+			t.Fatalf("runCommand = %d, %v", code, err)
+		}
+	}
+	ownChildren.Lock()
+	defer ownChildren.Unlock()
+	if len(ownChildren.pids) != 0 {
+		t.Fatalf("expected every command to be forgotten, got %v", ownChildren.pids)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"time"
+)
+
+// newProcessTree is only supported on Linux, where confik can become a child
+// subreaper.
+func newProcessTree(grace time.Duration) (*processTree, error) {
+	return nil, errors.New("--wait-tree is only supported on Linux")
+}
+
+func (t *processTree) prepare(cmd *exec.Cmd) {}
+
+func (t *processTree) started(pid int) {}
+
+func (t *processTree) wait() {}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestWaitTreeKeepsStagingForBackgroundProcesses(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("--wait-tree requires linux")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	script := "(sleep 0.3; cat example.txt > seen.txt) >/dev/null 2>&1 & exit 0"
+	code, _, stderr := runConfik(t, dir, "--wait-tree", "sh", "-c", script)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "seen.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("expected background process to read the staged file, got %q, %v (stderr: %s)", data, err, stderr)
+	}
+	if exists(filepath.Join(dir, "example.txt")) {
+		t.Fatalf("expected staged file to be cleaned up after the tree exited")
+	}
+	if !strings.Contains(stderr, "waiting for 1 background process(es)") {
+		t.Fatalf("expected wait message, got: %s", stderr)
+	}
+}
+
+func TestWaitTreeWaitsForDetachedSessions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("--wait-tree requires linux")
+	}
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("setsid not available")
+	}
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	// A daemon that starts a session of its own is still part of the tree.
+	script := "setsid sh -c 'sleep 0.3; cat example.txt > seen.txt' >/dev/null 2>&1 & exit 0"
+	code, _, stderr := runConfik(t, dir, "--wait-tree", "sh", "-c", script)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "seen.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("expected the detached process to read the staged file, got %q, %v (stderr: %s)", data, err, stderr)
+	}
+	if !strings.Contains(stderr, "waiting for 1 background process(es)") {
+		t.Fatalf("expected to wait for the detached process only, got: %s", stderr)
+	}
+}
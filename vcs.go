@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const (
+	vcsGit       = "git"
+	vcsMercurial = "hg"
+)
+
+// findVCSRoot returns the nearest ancestor of start that holds a .git or .hg
+// entry, together with the kind of repository found there.
+func findVCSRoot(start string) (string, string) {
+	current, err := filepath.Abs(start)
+	if err != nil {
+		return "", ""
+	}
+	for {
+		if exists(filepath.Join(current, ".git")) {
+			return current, vcsGit
+		}
+		if isDirectory(filepath.Join(current, ".hg")) {
+			return current, vcsMercurial
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return "", ""
+		}
+		current = parent
+	}
+}
+
+// applyVCSIgnore registers staged files with the enclosing repository's
+// ignore mechanism. At most one of the returned contexts is non-nil.
+func applyVCSIgnore(cwd, runID string, createdFiles []string) (*GitContext, *HgContext) {
+	root, kind := findVCSRoot(cwd)
+	switch kind {
+	case vcsGit:
+		return applyGitIgnore(root, runID, createdFiles), nil
+	case vcsMercurial:
+		return nil, applyHgIgnore(root, runID, createdFiles)
+	}
+	return nil, nil
+}
+
+// vcsRelativePaths converts absolute paths to slash-separated paths relative
+// to root, dropping any that fall outside it.
+func vcsRelativePaths(root string, paths []string) []string {
+	out := []string{}
+	for _, filePath := range paths {
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(rel, "..") {
+			continue
+		}
+		out = append(out, filepath.ToSlash(rel))
+	}
+	return out
+}
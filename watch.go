@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// watchDebounce collects the burst of events an editor or git checkout
+// produces into a single re-sync.
+const watchDebounce = 100 * time.Millisecond
+
+// stagingSync keeps an active staging in line with .config/ while --watch is
+// in effect. It works from the manifest on disk, so any participant of a
+// shared staging can run it.
+type stagingSync struct {
+	cwd          string
+	configDir    string
+	lockPath     string
+	manifestPath string
+	backend      string
+	gitignore    bool
+	registry     bool
+	// overrides are applied to confik.json each time it is read.
+	overrides configOverrides
+	// command selects the commands entry in confik.json that limits which
+	// files this run adds.
+	command string
+	// injected holds files passed to the command instead of being staged.
+	injected map[string]bool
+}
+
+type syncResult struct {
+	added   int
+	updated int
+	removed int
+}
+
+func (r syncResult) changed() bool {
+	return r.added+r.updated+r.removed > 0
+}
+
+// watch re-syncs the staging whenever .config/ changes until the returned
+// function is called. After every re-sync that changed a staged file,
+// onChange is called and, if group is set, the command is bounced.
+func (s *stagingSync) watch(group *processGroup, onChange func()) func() {
+	changes := make(chan struct{}, 1)
+	watcher, err := watchConfigDir(s.configDir, changes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "confik: %v; not watching .config for changes\n", err)
+		return func() {}
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		s.loop(changes, done, group, onChange)
+	}()
+	return func() {
+		close(done)
+		_ = watcher.Close()
+		<-finished
+	}
+}
+
+func (s *stagingSync) loop(changes <-chan struct{}, done <-chan struct{}, group *processGroup, onChange func()) {
+	for {
+		select {
+		case <-changes:
+		case <-done:
+			return
+		}
+		timer := time.NewTimer(watchDebounce)
+	debounce:
+		for {
+			select {
+			case <-changes:
+				timer.Reset(watchDebounce)
+			case <-timer.C:
+				break debounce
+			case <-done:
+				timer.Stop()
+				return
+			}
+		}
+
+		result, err := s.resync()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "confik: re-staging incomplete (%v)\n", err)
+		}
+		if !result.changed() {
+			continue
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "confik: re-staged .config (%d added, %d updated, %d removed)\n", result.added, result.updated, result.removed)
+		onChange()
+		if group != nil {
+			bounceCommand(group)
+		}
+	}
+}
+
+// bounceCommand stops the command so that it is started again, killing it if
+// it is still running after the grace period.
+func bounceCommand(group *processGroup) {
+	pid := group.bounce(syscall.SIGTERM)
+	if pid <= 0 {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "confik: .config changed, restarting command...")
+	time.AfterFunc(timeoutGracePeriod, func() {
+		if group.stillBouncing(pid) {
+			group.signal(syscall.SIGKILL)
+		}
+	})
+}
+
+// resync brings the staged copies, manifest and ignore rules up to date with
+// .config/ under the project lock.
+func (s *stagingSync) resync() (syncResult, error) {
+	lock, err := acquireLock(s.lockPath, LockOptions{Backend: s.backend})
+	if err != nil {
+		return syncResult{}, err
+	}
+	manifest, err := readManifest(s.manifestPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// The staging has already been cleaned up.
+			err = nil
+		}
+		return syncResult{}, combineErrors(err, lock.Unlock())
+	}
+	result, err := s.apply(manifest, false)
+	return result, combineErrors(err, lock.Unlock())
+}
+
+// apply stages the files this run selects that are missing from the project
+// root. Unless addOnly is set, it also updates staged copies and removes those
+// no longer in .config/. What stays staged is decided without the command
+// selection, since other participants of the staging may rely on it.
+func (s *stagingSync) apply(manifest *Manifest, addOnly bool) (syncResult, error) {
+	var result syncResult
+	var syncErr error
+
+	config, err := s.overrides.apply(loadConfig(s.configDir))
+	if err != nil {
+		return result, err
+	}
+	entries := listWorkingTreeEntries(s.configDir)
+	keep := newStageFilter(config, s.registry && config.Registry).withGitIgnored(s.cwd, config, entries)
+	filter := keep.forCommand(config, s.command)
+	filter.injected = s.injected
+
+	staged := map[string]bool{}
+	for _, rel := range stagedConfigFiles(s.cwd, manifest) {
+		staged[rel] = true
+	}
+	createdDirs := make([]string, 0, len(manifest.CreatedDirs))
+	for _, rel := range manifest.CreatedDirs {
+		createdDirs = append(createdDirs, filepath.Join(s.cwd, filepath.FromSlash(rel)))
+	}
+
+	wanted := map[string]bool{}
+	if addOnly {
+		for rel := range staged {
+			wanted[rel] = true
+		}
+	}
+	for _, entry := range entries {
+		dest := filepath.Join(s.cwd, filepath.FromSlash(entry.Rel))
+		if staged[entry.Rel] {
+			if keep.classify(entry.Rel) != entryStage {
+				continue
+			}
+			wanted[entry.Rel] = true
+			if addOnly || sameFileContent(entry.Path, dest) {
+				continue
+			}
+			if err := copyEntry(s.cwd, entry, dest); err != nil {
+				syncErr = combineErrors(syncErr, fmt.Errorf("update %s: %v", dest, err))
+				continue
+			}
+			result.updated++
+			continue
+		}
+		if filter.classify(entry.Rel) != entryStage || exists(dest) {
+			continue
+		}
+		ok, err := ensureDirWithCache(filepath.Dir(dest), &createdDirs, false, nil)
+		if err != nil || !ok {
+			syncErr = combineErrors(syncErr, fmt.Errorf("stage %s: cannot create parent directory", dest))
+			continue
+		}
+		if err := copyEntry(s.cwd, entry, dest); err != nil {
+			syncErr = combineErrors(syncErr, fmt.Errorf("stage %s: %v", dest, err))
+			continue
+		}
+		wanted[entry.Rel] = true
+		result.added++
+	}
+
+	for rel := range staged {
+		if wanted[rel] {
+			continue
+		}
+		dest := filepath.Join(s.cwd, filepath.FromSlash(rel))
+		if err := os.Remove(dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+			syncErr = combineErrors(syncErr, fmt.Errorf("remove %s: %v", dest, err))
+			wanted[rel] = true
+			continue
+		}
+		result.removed++
+	}
+
+	if result.added+result.removed == 0 {
+		return result, syncErr
+	}
+
+	// The set of staged files changed: rebuild the ignore rules around it.
+	if manifest.VSCode != nil {
+		if err := removeVSCodeExcludes(manifest.VSCode); err != nil {
+			syncErr = combineErrors(syncErr, fmt.Errorf("remove VS Code excludes: %v", err))
+		}
+		manifest.VSCode = nil
+	}
+	if manifest.Gitignore != nil {
+		if err := removeGitIgnoreBlock(manifest.Gitignore.ExcludePath, manifest.Gitignore.RunID); err != nil {
+			syncErr = combineErrors(syncErr, fmt.Errorf("remove gitignore block: %v", err))
+		}
+		manifest.Gitignore = nil
+	}
+	if manifest.Mercurial != nil {
+		if err := removeHgIgnoreBlock(manifest.Mercurial); err != nil {
+			syncErr = combineErrors(syncErr, fmt.Errorf("remove hgignore block: %v", err))
+		}
+		manifest.Mercurial = nil
+	}
+
+	wantedRels := make([]string, 0, len(wanted))
+	for rel := range wanted {
+		wantedRels = append(wantedRels, rel)
+	}
+	sort.Strings(wantedRels)
+	createdFiles := make([]string, 0, len(wantedRels))
+	for _, rel := range wantedRels {
+		createdFiles = append(createdFiles, filepath.Join(s.cwd, filepath.FromSlash(rel)))
+	}
+
+	createdDirs = uniqueStrings(createdDirs)
+	sort.Slice(createdDirs, func(i, j int) bool { return len(createdDirs[i]) > len(createdDirs[j]) })
+	remainingDirs := []string{}
+	for _, dirPath := range createdDirs {
+		if removed, err := removeDirIfEmptyChecked(dirPath); err != nil || !removed {
+			remainingDirs = append(remainingDirs, dirPath)
+		}
+	}
+	sort.Strings(remainingDirs)
+
+	if config.VSCodeExclude && len(createdFiles) > 0 {
+		ctx, err := applyVSCodeExcludes(s.cwd, append([]string(nil), createdFiles...), &createdFiles, &remainingDirs)
+		if err != nil {
+			syncErr = combineErrors(syncErr, fmt.Errorf("update .vscode/settings.json: %v", err))
+		} else {
+			manifest.VSCode = ctx
+		}
+	}
+	if s.gitignore && config.Gitignore && len(createdFiles) > 0 {
+		manifest.Gitignore, manifest.Mercurial = applyVCSIgnore(s.cwd, manifest.RunID, createdFiles)
+	}
+
+	manifest.CreatedFiles = toRelativeList(s.cwd, createdFiles)
+	manifest.CreatedDirs = toRelativeList(s.cwd, remainingDirs)
+	return result, combineErrors(syncErr, writeManifest(s.manifestPath, *manifest))
+}
+
+func sameFileContent(a, b string) bool {
+	// #nosec G304 -- a is a file below .config/.
+	left, err := os.ReadFile(a)
+	if err != nil {
+		return false
+	}
+	// #nosec G304 -- b is its staged copy in the project root.
+	right, err := os.ReadFile(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(left, right)
+}
@@ -0,0 +1,142 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchEventMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+	unix.IN_DELETE | unix.IN_DELETE_SELF | unix.IN_ATTRIB
+
+// configWatcher watches a directory tree with inotify. New subdirectories
+// are watched as they appear.
+type configWatcher struct {
+	file    *os.File
+	fd      int
+	root    string
+	changes chan<- struct{}
+
+	mu   sync.Mutex
+	dirs map[int]string
+}
+
+// watchConfigDir reports changes below root on changes until the returned
+// closer is closed. Reports are coalesced: changes never blocks the watcher.
+func watchConfigDir(root string, changes chan<- struct{}) (io.Closer, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// A non-blocking descriptor goes through the runtime poller, so Close
+	// interrupts a pending Read. File.Fd would make it blocking again, which
+	// is why the raw descriptor is kept as well.
+	w := &configWatcher{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+		root:    root,
+		changes: changes,
+		dirs:    map[int]string{},
+	}
+	if err := w.addTree(root); err != nil {
+		_ = w.file.Close()
+		return nil, err
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *configWatcher) Close() error {
+	return w.file.Close()
+}
+
+// addTree watches dir and every directory below it.
+func (w *configWatcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(pathname string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			if pathname == dir {
+				return walkErr
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, pathname, watchEventMask)
+		if err != nil {
+			if pathname == dir {
+				return os.NewSyscallError("inotify_add_watch", err)
+			}
+			return nil
+		}
+		w.mu.Lock()
+		w.dirs[wd] = pathname
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *configWatcher) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		changed := false
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			// #nosec G103 -- the kernel writes struct inotify_event records into buf.
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			if nameEnd > n {
+				break
+			}
+			name := strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00")
+			offset = nameEnd
+			if w.handle(event, name) {
+				changed = true
+			}
+		}
+		if changed {
+			select {
+			case w.changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// handle keeps the set of watched directories current and reports whether
+// the event may affect the staging.
+func (w *configWatcher) handle(event *unix.InotifyEvent, name string) bool {
+	wd := int(event.Wd)
+	w.mu.Lock()
+	dir, ok := w.dirs[wd]
+	if event.Mask&unix.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+	}
+	w.mu.Unlock()
+	if !ok || event.Mask&unix.IN_IGNORED != 0 {
+		return false
+	}
+
+	pathname := filepath.Join(dir, name)
+	if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+		// Files written before the watch was added are picked up by the
+		// re-sync that this event triggers.
+		_ = w.addTree(pathname)
+	}
+	if rel, err := filepath.Rel(w.root, pathname); err == nil && isStateFile(filepath.ToSlash(rel)) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitForCondition(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func fileContains(pathname, want string) bool {
+	data, err := os.ReadFile(pathname)
+	return err == nil && strings.Contains(string(data), want)
+}
+
+const waitForStopScript = `while ! test -f stop; do sleep 0.05; done`
+
+func TestWatchPropagatesChangesToStaging(t *testing.T) {
+	dir := t.TempDir()
+	initGitRepo(t, dir)
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	for name, content := range map[string]string{"a.txt": "one", "b.txt": "bee", "c.txt": "sea"} {
+		if err := os.WriteFile(filepath.Join(configDir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	cmd, output := startConfik(t, dir, "--watch", "sh", "-c", waitForStopScript)
+	waitForPath(t, filepath.Join(dir, "a.txt"))
+	excludePath := filepath.Join(dir, ".git", "info", "exclude")
+
+	if err := os.WriteFile(filepath.Join(configDir, "a.txt"), []byte("two"), 0o644); err != nil {
+		t.Fatalf("update a.txt: %v", err)
+	}
+	waitForCondition(t, "updated a.txt", func() bool { return fileContains(filepath.Join(dir, "a.txt"), "two") })
+
+	if err := os.MkdirAll(filepath.Join(configDir, "sub"), 0o755); err != nil {
+		t.Fatalf("mkdir sub: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "sub", "d.txt"), []byte("dee"), 0o644); err != nil {
+		t.Fatalf("write d.txt: %v", err)
+	}
+	waitForPath(t, filepath.Join(dir, "sub", "d.txt"))
+	waitForCondition(t, "exclude entry for sub/d.txt", func() bool { return fileContains(excludePath, "/sub/d.txt") })
+
+	if err := os.Remove(filepath.Join(configDir, "b.txt")); err != nil {
+		t.Fatalf("remove b.txt: %v", err)
+	}
+	waitForCondition(t, "b.txt removal", func() bool { return !exists(filepath.Join(dir, "b.txt")) })
+
+	if err := os.WriteFile(filepath.Join(configDir, configFilename), []byte(`{"exclude":["c.txt"]}`), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	waitForCondition(t, "c.txt exclusion", func() bool { return !exists(filepath.Join(dir, "c.txt")) })
+	// The manifest is written after the staged copies are removed.
+	waitForCondition(t, "manifest listing a.txt and sub/d.txt", func() bool {
+		manifest, err := readManifest(filepath.Join(configDir, manifestFilename))
+		return err == nil && strings.Join(manifest.CreatedFiles, ",") == "a.txt,sub/d.txt"
+	})
+	if fileContains(excludePath, "/b.txt") || fileContains(excludePath, "/c.txt") {
+		t.Fatalf("expected removed files to leave the exclude block")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "stop"), nil, 0o644); err != nil {
+		t.Fatalf("write stop: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("confik failed: %v (output: %s)", err, output.String())
+	}
+	for _, name := range []string{"a.txt", "sub", filepath.Join(".config", manifestFilename)} {
+		if exists(filepath.Join(dir, name)) {
+			t.Fatalf("expected %s to be cleaned up", name)
+		}
+	}
+	if fileContains(excludePath, "confik") {
+		t.Fatalf("expected exclude block to be removed")
+	}
+}
+
+func TestWatchStartsFromEmptyStaging(t *testing.T) {
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+
+	cmd, output := startConfik(t, dir, "--watch", "sh", "-c", waitForStopScript)
+	waitForPath(t, filepath.Join(configDir, manifestFilename))
+	if err := os.WriteFile(filepath.Join(configDir, "late.txt"), []byte("late"), 0o644); err != nil {
+		t.Fatalf("write late.txt: %v", err)
+	}
+	waitForPath(t, filepath.Join(dir, "late.txt"))
+
+	if err := os.WriteFile(filepath.Join(dir, "stop"), nil, 0o644); err != nil {
+		t.Fatalf("write stop: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("confik failed: %v (output: %s)", err, output.String())
+	}
+	if exists(filepath.Join(dir, "late.txt")) {
+		t.Fatalf("expected late.txt to be cleaned up")
+	}
+}
+
+func TestWatchRestartBouncesCommand(t *testing.T) {
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("one"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	script := `cat example.txt >> runs.txt; echo >> runs.txt; ` + waitForStopScript
+	cmd, output := startConfik(t, dir, "--watch-restart", "sh", "-c", script)
+	runsPath := filepath.Join(dir, "runs.txt")
+	waitForCondition(t, "first run", func() bool { return fileContains(runsPath, "one") })
+
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("two"), 0o644); err != nil {
+		t.Fatalf("update source: %v", err)
+	}
+	waitForCondition(t, "restarted run", func() bool { return fileContains(runsPath, "two") })
+
+	if err := os.WriteFile(filepath.Join(dir, "stop"), nil, 0o644); err != nil {
+		t.Fatalf("write stop: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("confik failed: %v (output: %s)", err, output.String())
+	}
+	if !strings.Contains(output.String(), "restarting command") {
+		t.Fatalf("expected restart message, got: %s", output.String())
+	}
+	if exists(filepath.Join(dir, "example.txt")) {
+		t.Fatalf("expected staged file to be cleaned up")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func watchConfigDir(root string, changes chan<- struct{}) (io.Closer, error) {
+	return nil, errors.New("--watch is only supported on Linux")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// watchdogCommand is the hidden subcommand the watchdog process runs as.
+const watchdogCommand = "__watchdog"
+
+// watchdogFD is the descriptor on which the watchdog inherits the read end of
+// the pipe whose write end only the supervised run holds.
+const watchdogFD = 3
+
+// selfCommand builds a command that re-executes confik with args.
+var selfCommand = func(args ...string) (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	// #nosec G204 -- re-executes the running confik binary with internal arguments.
+	return exec.Command(executable, args...), nil
+}
+
+// runWatchdog waits for the supervised run to go away. The pipe reaches EOF
+// when the run exits for any reason, including SIGKILL or the OOM killer; if
+// the session record is still there at that point the run never got to clean
+// up, so the watchdog detaches it from the staging on its behalf.
+func runWatchdog(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: confik " + watchdogCommand + " <session-record>")
+	}
+	// Ctrl+C and hangups are meant for the run; the watchdog outlives it.
+	signal.Ignore(syscall.SIGINT, syscall.SIGHUP)
+
+	parent := os.NewFile(watchdogFD, "watchdog")
+	if parent == nil {
+		return errors.New("watchdog pipe missing")
+	}
+	_, _ = io.Copy(io.Discard, parent)
+	_ = parent.Close()
+
+	record, err := readSessionRecord(args[0])
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	detach := sessionDetacher(record.ProjectDir, record.LockPath, record.ManifestPath, record.LockBackend, record.PID)
+	if err := detach(); err != nil {
+		return fmt.Errorf("cleanup after run %s (pid %d) incomplete (%v); run `confik gc` to retry", record.RunID, record.PID, err)
+	}
+	if err := os.Remove(record.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "confik: run %s (pid %d) exited without cleaning up; watchdog cleaned up after it\n", record.RunID, record.PID)
+	return nil
+}
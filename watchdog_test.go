@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdogCleansUpAfterSIGKILL(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the wrapped command is only stopped via the parent-death signal on linux")
+	}
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	staged := filepath.Join(dir, "example.txt")
+
+	cmd, output := startConfik(t, dir, "sh", "-c", "touch command.started; exec sleep 30")
+	waitForPath(t, filepath.Join(dir, "command.started"))
+	if !exists(staged) {
+		t.Fatalf("expected file to be staged before the kill")
+	}
+
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatalf("kill confik: %v", err)
+	}
+	// Wait also waits for the watchdog and the command to release the output pipe.
+	done := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		t.Fatalf("watchdog or command still running after confik was killed (output: %s)", output)
+	}
+
+	if exists(staged) || exists(filepath.Join(configDir, manifestFilename)) {
+		t.Fatalf("expected watchdog to remove staged files (output: %s)", output)
+	}
+	if !strings.Contains(output.String(), "watchdog cleaned up") {
+		t.Fatalf("expected watchdog message, got: %s", output)
+	}
+	records, err := listSessions()
+	if err != nil {
+		t.Fatalf("listSessions error: %v", err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("expected watchdog to drop the session record, got %#v", records)
+	}
+}
+
+func TestWatchdogIdleAfterCleanExit(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, ".config")
+	if err := os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatalf("mkdir config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "example.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	code, _, stderr := runConfik(t, dir, testCommandArgs(0)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if strings.Contains(stderr, "watchdog") {
+		t.Fatalf("expected watchdog to stay quiet after a clean exit, got: %s", stderr)
+	}
+}
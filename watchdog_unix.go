@@ -0,0 +1,42 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// startWatchdog launches a watchdog process for the session recorded at
+// recordPath and returns the write end of its pipe. Closing it (or exiting)
+// tells the watchdog the run is over.
+func startWatchdog(recordPath string) (*os.File, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = reader.Close() }()
+
+	cmd, err := selfCommand(watchdogCommand, recordPath)
+	if err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{reader}
+	// A session of its own keeps terminal signals away from the watchdog. It
+	// is an own child so that --wait-tree does not wait for it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := startOwnChild(cmd); err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	// Reap the watchdog if it exits before confik does, so its pid does not
+	// stay among the own children.
+	pid := cmd.Process.Pid
+	go func() {
+		_ = cmd.Wait()
+		forgetOwnChild(pid)
+	}()
+	return writer, nil
+}